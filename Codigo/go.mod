@@ -1,3 +1,5 @@
 module nether
 
 go 1.21.1
+
+require golang.org/x/crypto v0.33.0
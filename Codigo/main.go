@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"nether/nether"
 	"os"
@@ -9,25 +10,48 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func help() {
 	fmt.Println("Commands:")
 	fmt.Println("help ---------------- You're here")
 	fmt.Println("clear --------------- clear the console")
-	fmt.Println("register ------------ register a new user")
-	fmt.Println("login --------------- login with a user")
+	fmt.Println("register <name> ----- register a new identity in the keystore")
+	fmt.Println("login [name] -------- login as an identity, the default one when no name is given")
+	fmt.Println("list identities ----- list the identities in the keystore")
+	fmt.Println("default identity ---- choose the identity used when login has no name")
+	fmt.Println("change password ----- re-encrypt the userdata with a new password")
+	fmt.Println("export key ---------- save the key to a password protected PEM file")
+	fmt.Println("import key ---------- add the key of a PEM backup as a new identity")
 	fmt.Println("test userdata ------- test userdata sanity checks")
 	fmt.Println("show userdata ------- print userdata in console")
 	fmt.Println("new blockchain ------ create a new blockchain")
+	fmt.Println("memory blockchain --- create a new blockchain kept only in memory")
 	fmt.Println("load blockchain ----- load blockchain from secundary memory to primary memory")
 	fmt.Println("show blockchain ----- print blockchain in console")
+	fmt.Println("show block ---------- print a block by height or by hex hash")
+	fmt.Println("list blocks --------- print the blocks in a height/date range, optionally by signer")
+	fmt.Println("rebuild index ------- rebuild the block index of the blockchain")
+	fmt.Println("verify blockchain --- verify hashes, links and signatures of every block")
+	fmt.Println("find embedding ------ show the block holding an embedding ID")
+	fmt.Println("verify images ------- check stored images against the hashes in the blockchain")
+	fmt.Println("verify segments ----- check sealed blockchain segments against the manifest checksums")
+	fmt.Println("migrate blockchain -- rewrite an older blockchain file into the current format")
 	fmt.Println("start server -------- start server")
 	fmt.Println("start client -------- start client")
 	fmt.Println("ping all ------------ ping all connections")
 	fmt.Println("start election ------ start election for new leaders(only a leader can start an election)")
 	fmt.Println("show connections ---- show all connections of the node")
+	fmt.Println("show queues --------- show the outbound queue of each connection")
 	fmt.Println("download blockchain - download blockchain from a leader")
+	fmt.Println("download image ------ download an image by its hash from a leader")
+	fmt.Println("fast sync ----------- bootstrap the blockchain from a checkpoint signed by the leaders")
+	fmt.Println("sync blocks --------- download the blocks after the last local block from a leader")
+	fmt.Println("light mode ---------- toggle storing only the headers of the blocks received from leaders")
+	fmt.Println("create checkpoint --- sign a checkpoint of the local blockchain (leaders only)")
+	fmt.Println("show checkpoint ----- print the stored checkpoint")
+	fmt.Println("trust leader -------- count the checkpoint signatures of a leader public key")
 	fmt.Println("start endpoint ------ start endpoint connection to receive camera aplication infos")
 	fmt.Println("exit ---------------- exit the program")
 }
@@ -69,11 +93,91 @@ func inputNumber(prompt string) int {
 	}
 }
 
-func register() {
-	nether.Register(input("Type your password: "))
+func register(name string) {
+	if name == "" {
+		name = input("Type the identity name: ")
+	}
+
+	if err := nether.Register(name, input("Type your password: ")); err != nil {
+		fmt.Println("Cannot register:", err)
+		return
+	}
+	fmt.Println("Identity", name, "registered")
+}
+
+func listIdentities() {
+	names, defaultName, err := nether.ListIdentities()
+	if err != nil {
+		fmt.Println("Cannot read keystore:", err)
+		return
+	}
+
+	for _, name := range names {
+		if name == defaultName {
+			fmt.Println(name, "(default)")
+		} else {
+			fmt.Println(name)
+		}
+	}
+}
+
+func defaultIdentity(name string) {
+	if name == "" {
+		name = input("Type the identity name: ")
+	}
+
+	if err := nether.SetDefaultIdentity(name); err != nil {
+		fmt.Println("Cannot set default identity:", err)
+		return
+	}
+	fmt.Println("Node runs as", name, "when no identity is given at login")
+}
+
+func changePassword() {
+	oldPassword := input("Type your current password: ")
+	newPassword := input("Type the new password: ")
+	if newPassword != input("Type the new password again: ") {
+		fmt.Println("Passwords do not match")
+		return
+	}
+
+	if err := nether.ChangePassword(oldPassword, newPassword); err != nil {
+		fmt.Println("Cannot change password:", err)
+		return
+	}
+	fmt.Println("Password changed")
+}
+
+func exportKey() {
+	path := input("Type the backup file path: ")
+	password := input("Type the backup password: ")
+	if password != input("Type the backup password again: ") {
+		fmt.Println("Passwords do not match")
+		return
+	}
+
+	if err := nether.ExportKey(path, password); err != nil {
+		fmt.Println("Cannot export key:", err)
+		return
+	}
+	fmt.Println("Key exported to", path)
+}
+
+func importKey() {
+	path := input("Type the backup file path: ")
+	backupPassword := input("Type the backup password: ")
+	name := input("Type the name of the new identity: ")
+	password := input("Type the password of the new identity: ")
+
+	if err := nether.ImportKey(path, backupPassword, name, password); err != nil {
+		fmt.Println("Cannot import key:", err)
+		return
+	}
+	fmt.Println("Key imported as identity", name)
 }
 
 func testUserdata() {
+	name := nether.CurrentIdentity()
 	fmt.Println(nether.GetUserdata())
 
 	fmt.Println("Resetting userdata")
@@ -81,7 +185,7 @@ func testUserdata() {
 	fmt.Println(nether.GetUserdata())
 
 	fmt.Println("Reopening ...")
-	load()
+	load(name)
 	fmt.Println(nether.GetUserdata())
 }
 
@@ -89,19 +193,167 @@ func showUserdata() {
 	fmt.Println(nether.GetUserdata())
 }
 
-func load() {
-	if success := nether.LoadData(input("Please type your password: ")); success {
-		fmt.Println("Successfully logged")
+func load(name string) {
+	if success := nether.LoadData(name, input("Please type your password: ")); success {
+		fmt.Println("Successfully logged as", nether.CurrentIdentity())
 	} else {
 		fmt.Println("Wrong password")
 	}
 }
 
 func autoLogin() {
-	nether.LoadData("teste123")
+	nether.LoadData("", "teste123")
 	nether.LoadBlockchain()
 }
 
+func showBlock() {
+	key := input("Type the block height or hash: ")
+
+	var block *nether.Block
+	var err error
+	if height, parseErr := strconv.ParseUint(key, 10, 64); parseErr == nil {
+		block, err = nether.ReadBlockAt(height)
+	} else if hash, hashErr := nether.DecodeHash(key); hashErr == nil {
+		block, err = nether.ReadBlockByHash(hash)
+	} else {
+		err = fmt.Errorf("invalid height or hash: %s", key)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if block.HeaderOnly {
+		if full, fetchErr := nether.FetchPayload(block); fetchErr == nil {
+			block = full
+		} else {
+			fmt.Println("Cannot fetch block storage:", fetchErr)
+		}
+	}
+	fmt.Printf("Block [%03d]:\n%s\n", block.Index, block)
+}
+
+func listBlocks() {
+	var filter nether.Filter
+	var err error
+
+	if from := input("From height (empty for genesis): "); from != "" {
+		if filter.FromIndex, err = strconv.ParseUint(from, 10, 64); err != nil {
+			fmt.Println("Invalid height:", err)
+			return
+		}
+	}
+	if to := input("To height (empty for last block): "); to != "" {
+		height, err := strconv.ParseUint(to, 10, 64)
+		if err != nil {
+			fmt.Println("Invalid height:", err)
+			return
+		}
+		filter.ToIndex = &height
+	}
+	if from := input("From date YYYY-MM-DD (empty for any): "); from != "" {
+		if filter.FromTime, err = time.ParseInLocation("2006-01-02", from, time.Local); err != nil {
+			fmt.Println("Invalid date:", err)
+			return
+		}
+	}
+	if to := input("To date YYYY-MM-DD (empty for any): "); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			fmt.Println("Invalid date:", err)
+			return
+		}
+		filter.ToTime = day.Add(24*time.Hour - time.Second)
+	}
+	if signer := input("Signer public key in base64 (empty for any): "); signer != "" {
+		pk, err := nether.DecodePublicKey(signer)
+		if err != nil {
+			fmt.Println("Invalid public key:", err)
+			return
+		}
+		filter.SignerPubKey = &pk
+	}
+
+	count := 0
+	err = nether.IterateChain(context.Background(), filter, func(block *nether.Block) bool {
+		fmt.Printf("Block [%03d]:\n%s\n", block.Index, block)
+		count++
+		return true
+	})
+	if err != nil {
+		fmt.Println("Cannot read blockchain:", err)
+	}
+	fmt.Printf("%d blocks found\n", count)
+}
+
+func rebuildIndex() {
+	if err := nether.RebuildIndex(); err != nil {
+		fmt.Println("Cannot rebuild index:", err)
+	} else {
+		fmt.Println("Index rebuilt")
+	}
+}
+
+func verifyBlockchain() {
+	if err := nether.VerifyChain(); err != nil {
+		fmt.Println("Blockchain is invalid:", err)
+	} else {
+		fmt.Println("Blockchain is valid")
+	}
+}
+
+func findEmbedding() {
+	id, err := nether.DecodeHash(input("Type the embedding ID: "))
+	if err != nil {
+		fmt.Println("Invalid embedding ID:", err)
+		return
+	}
+
+	block, position, err := nether.FindByEmbeddingID(id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("Embedding %d of block %d:\n%s\n", position, block.Index, block)
+}
+
+func verifyImages() {
+	missing, err := nether.VerifyImages()
+	if err != nil {
+		fmt.Println("Image database is invalid:", err)
+		return
+	}
+	fmt.Printf("Images are valid, %d not stored locally\n", len(missing))
+	for _, hash := range missing {
+		fmt.Printf("missing: %x\n", hash)
+	}
+}
+
+func verifySegments() {
+	archived, err := nether.VerifySegments()
+	if err != nil {
+		fmt.Println("Segments are invalid:", err)
+		return
+	}
+	fmt.Printf("Segments are valid, %d in cold storage\n", len(archived))
+	for _, name := range archived {
+		fmt.Println("archived:", name)
+	}
+}
+
+func migrateBlockchain() {
+	migrated, err := nether.MigrateChain()
+	switch {
+	case err != nil:
+		fmt.Println("Cannot migrate blockchain:", err)
+	case migrated:
+		fmt.Println("Blockchain migrated, old file kept with .legacy suffix")
+	default:
+		fmt.Println("Blockchain is already in the current format")
+	}
+}
+
 func startServer() {
 	go func() {
 		if err := nether.StartAsLeader(); err != nil {
@@ -141,8 +393,82 @@ func showConnections() {
 	}()
 }
 
+func showQueues() {
+	if err := nether.ShowQueues(); err != nil {
+		fmt.Println(err)
+	}
+}
+
 func downloadBlockchain() {
-	go nether.RequestBlockchain()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if err := nether.DownloadBlockchain(ctx); err != nil {
+			fmt.Println("Cannot download blockchain:", err)
+		}
+	}()
+}
+
+func downloadImage() {
+	hash := input("Type the image hash: ")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), nether.RPC_TIMEOUT)
+		defer cancel()
+
+		if err := nether.RequestImage(ctx, hash); err != nil {
+			fmt.Println("Cannot download image:", err)
+		}
+	}()
+}
+
+func fastSync() {
+	quorum, err := strconv.Atoi(input(fmt.Sprintf("Minimum leader signatures (default %d): ", nether.CHECKPOINT_QUORUM)))
+	if err != nil {
+		quorum = nether.CHECKPOINT_QUORUM
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if err := nether.FastSync(ctx, quorum); err != nil {
+			fmt.Println("Cannot fast sync:", err)
+		}
+	}()
+}
+
+func syncBlocks() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if err := nether.RequestBlocks(ctx); err != nil {
+			fmt.Println("Cannot sync blocks:", err)
+		}
+	}()
+}
+
+func toggleLightMode() {
+	nether.SetLightMode(!nether.LightMode())
+	if nether.LightMode() {
+		fmt.Println("Light mode enabled, blocks received from leaders are stored without their storage")
+	} else {
+		fmt.Println("Light mode disabled")
+	}
+}
+
+func createCheckpoint() {
+	if err := nether.ProduceCheckpoint(); err != nil {
+		fmt.Println("Cannot create checkpoint:", err)
+	}
+}
+
+func trustLeader() {
+	key := input("Type the leader public key: ")
+	if err := nether.TrustLeader(key); err != nil {
+		fmt.Println("Cannot trust leader:", err)
+	}
 }
 
 func startEndpoint() {
@@ -160,6 +486,15 @@ func main() {
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
 
+		// Identity commands take the identity name as argument
+		var name string
+		if fields := strings.Fields(input); len(fields) > 1 {
+			switch command := strings.Join(fields[:len(fields)-1], " "); command {
+			case "register", "login", "default identity":
+				input, name = command, fields[len(fields)-1]
+			}
+		}
+
 		switch input {
 		case "exit":
 			return
@@ -168,21 +503,49 @@ func main() {
 		case "clear":
 			clear()
 		case "register":
-			register()
+			register(name)
 		case "login":
-			load()
+			load(name)
+		case "list identities":
+			listIdentities()
+		case "default identity":
+			defaultIdentity(name)
 		case "auto login":
 			autoLogin()
+		case "change password":
+			changePassword()
+		case "export key":
+			exportKey()
+		case "import key":
+			importKey()
 		case "test userdata":
 			testUserdata()
 		case "show userdata":
 			showUserdata()
 		case "new blockchain":
 			nether.NewBlockchain()
+		case "memory blockchain":
+			nether.NewMemoryBlockchain()
 		case "load blockchain":
 			nether.LoadBlockchain()
 		case "show blockchain":
 			nether.PrintBlockchain()
+		case "show block":
+			showBlock()
+		case "rebuild index":
+			rebuildIndex()
+		case "verify blockchain":
+			verifyBlockchain()
+		case "list blocks":
+			listBlocks()
+		case "find embedding":
+			findEmbedding()
+		case "verify segments":
+			verifySegments()
+		case "verify images":
+			verifyImages()
+		case "migrate blockchain":
+			migrateBlockchain()
 		case "start server":
 			startServer()
 		case "start client":
@@ -193,8 +556,24 @@ func main() {
 			startElection()
 		case "show connections":
 			showConnections()
+		case "show queues":
+			showQueues()
 		case "download blockchain":
 			downloadBlockchain()
+		case "download image":
+			downloadImage()
+		case "fast sync":
+			fastSync()
+		case "light mode":
+			toggleLightMode()
+		case "sync blocks":
+			syncBlocks()
+		case "create checkpoint":
+			createCheckpoint()
+		case "show checkpoint":
+			fmt.Println(nether.CheckpointStatus())
+		case "trust leader":
+			trustLeader()
 		case "start endpoint":
 			startEndpoint()
 		default:
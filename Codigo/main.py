@@ -10,6 +10,7 @@ import os
 from deep_sort_realtime.deepsort_tracker import DeepSort
 import streamlit as st
 import tempfile
+import time
 
 # Carrega a rede YOLO
 net = cv2.dnn.readNet("data/facenet_config/yolov3-wider_16000.weights", "data/facenet_config/yolov3-face.cfg")
@@ -27,6 +28,9 @@ except AttributeError:
 # Configurações gerais
 QUANTOS_FRAMES_PARA_SALVAR = 5
 PROCESSAR_A_CADA_N_FRAMES = 2
+CAMERA_ID = os.environ.get("NETHER_CAMERA_ID", "camera-0")
+SITE_ID = os.environ.get("NETHER_SITE_ID", "site-0")
+DIRECAO = os.environ.get("NETHER_DIRECTION", "unknown")  # entry, exit ou unknown
 
 # Inicializa o Streamlit
 st.title("Detecção e Rastreamento de Faces (YOLO + DeepSort)")
@@ -76,10 +80,12 @@ def salvar_imagem_nao_mais_trackeada(tracks):
 
         max_confidence = 0
         max_confidence_face_chip = None
+        max_confidence_timestamp = None
         for data in datas:
             if data['confidence'] > max_confidence:
                 max_confidence = data['confidence']
                 max_confidence_face_chip = data['face_chip']
+                max_confidence_timestamp = data['timestamp']
 
         if max_confidence_face_chip is not None and max_confidence_face_chip.size > 0:
             face_dir_name = "data/faces/"
@@ -110,9 +116,20 @@ def salvar_imagem_nao_mais_trackeada(tracks):
                 continue
 
             # Preparar o payload JSON
+            with open(face_filename, 'rb') as face_file:
+                face_bytes = base64.b64encode(face_file.read()).decode('ascii')
+
             payload = {
                 "embeddings": embedding_numpy.tolist(),
-                "image_path": os.path.abspath(face_filename)
+                "image_path": os.path.abspath(face_filename),
+                "image": face_bytes,
+                "normalize": True,
+                "camera_id": CAMERA_ID,
+                "site_id": SITE_ID,
+                "direction": DIRECAO,
+                "confidence": float(max_confidence),
+                "track_id": str(track_id),
+                "captured_at": int(max_confidence_timestamp * 1000)
             }
 
             # Enviar os dados para o backend
@@ -248,7 +265,7 @@ while cap.isOpened():
             face_chip = frame[y1:y2, x1:x2]
             if track_id not in seen_ids_data:
                 seen_ids_data[track_id] = []
-            seen_ids_data[track_id].append({'confidence': confidence, 'face_chip': face_chip})
+            seen_ids_data[track_id].append({'confidence': confidence, 'face_chip': face_chip, 'timestamp': time.time()})
 
     stframe.image(frame, channels="BGR")
 
@@ -0,0 +1,238 @@
+package nether
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Peers prove they own the key they claim by signing a transcript holding the
+// nonce chosen by the other side. The ephemeral ECDH keys of the encrypted
+// transport are part of the transcript.
+//
+//	dialer -> AUTH_HELLO <pk> <nonce> <ephemeral>
+//	server -> AUTH_CHALLENGE <pk> <nonce> <ephemeral> <signature>
+//	dialer -> AUTH_PROOF <signature>
+const (
+	AUTH_NONCE_SIZE   int           = 32
+	AUTH_TIMEOUT      time.Duration = 10 * time.Second
+	AUTH_MAX_MESSAGE  uint32        = 1024
+	AUTH_DIALER_TAG   string        = "NETHER_AUTH_DIALER"
+	AUTH_LISTENER_TAG string        = "NETHER_AUTH_LISTENER"
+)
+
+type authHello struct {
+	PubKey    PublicKey
+	Nonce     []byte
+	Ephemeral []byte
+}
+
+// authTranscript is the digest signed by one side. Both keys and nonces are
+// covered so a signature cannot be replayed on another connection.
+func authTranscript(tag string, dialer authHello, listener authHello) Hash {
+	var buf bytes.Buffer
+	buf.WriteString(tag)
+	buf.Write(dialer.PubKey[:])
+	buf.Write(dialer.Nonce)
+	buf.Write(dialer.Ephemeral)
+	buf.Write(listener.PubKey[:])
+	buf.Write(listener.Nonce)
+	buf.Write(listener.Ephemeral)
+
+	return sha256.Sum256(buf.Bytes())
+}
+
+// newAuthHello returns our side of the handshake and the private half of its ephemeral key
+func newAuthHello() (authHello, *ecdh.PrivateKey, error) {
+	if userdata == nil {
+		return authHello{}, nil, fmt.Errorf("login before connecting to peers")
+	}
+
+	hello := authHello{PubKey: userdata.Key.Pk, Nonce: make([]byte, AUTH_NONCE_SIZE)}
+	if _, err := io.ReadFull(rand.Reader, hello.Nonce); err != nil {
+		return hello, nil, err
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return hello, nil, err
+	}
+	hello.Ephemeral = ephemeral.PublicKey().Bytes()
+
+	return hello, ephemeral, nil
+}
+
+func (h authHello) String() string {
+	return fmt.Sprintf("%s %s %s", EncodePublicKey(h.PubKey), base64.StdEncoding.EncodeToString(h.Nonce), base64.StdEncoding.EncodeToString(h.Ephemeral))
+}
+
+func encodeSignature(signature Signature) string {
+	return base64.StdEncoding.EncodeToString(signature[:])
+}
+
+func decodeSignature(src string) (Signature, error) {
+	var signature Signature
+	decoded, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return signature, err
+	}
+	if len(decoded) != SIGNATURE_SIZE {
+		return signature, fmt.Errorf("signature must have %d bytes, got %d", SIGNATURE_SIZE, len(decoded))
+	}
+
+	copy(signature[:], decoded)
+	return signature, nil
+}
+
+// Handshake messages are read as whole frames, so the first encrypted record
+// sent by the peer is never consumed with them
+func sendAuthMessage(message string, conn net.Conn) error {
+	return writeFrame(conn, FRAME_HANDSHAKE, []byte(message))
+}
+
+// readAuthMessage reads the next handshake message, which must be command
+// followed by count arguments
+func readAuthMessage(conn net.Conn, command string, count int) ([]string, error) {
+	frameType, data, err := readFrame(conn, AUTH_MAX_MESSAGE)
+	if err != nil {
+		return nil, err
+	}
+	if frameType != FRAME_HANDSHAKE {
+		return nil, fmt.Errorf("expected a handshake frame, got type %#x", frameType)
+	}
+	message := string(data)
+
+	parts := strings.Fields(message)
+	if len(parts) != count+1 || parts[0] != command {
+		return nil, fmt.Errorf("expected %s, got %q", command, firstWord(message))
+	}
+	return parts[1:], nil
+}
+
+func firstWord(message string) string {
+	if parts := strings.Fields(message); len(parts) > 0 {
+		return parts[0]
+	}
+	return ""
+}
+
+func parseAuthHello(parts []string) (authHello, error) {
+	var hello authHello
+	var err error
+
+	if hello.PubKey, err = DecodePublicKey(parts[0]); err != nil {
+		return hello, fmt.Errorf("invalid public key: %w", err)
+	}
+	if hello.Nonce, err = base64.StdEncoding.DecodeString(parts[1]); err != nil || len(hello.Nonce) != AUTH_NONCE_SIZE {
+		return hello, fmt.Errorf("invalid nonce")
+	}
+	if hello.Ephemeral, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return hello, fmt.Errorf("invalid ephemeral key")
+	}
+	if _, err := ecdh.P256().NewPublicKey(hello.Ephemeral); err != nil {
+		return hello, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	return hello, nil
+}
+
+// verifyAuth checks the signature of signer over the transcript tagged with tag
+func verifyAuth(tag string, dialer authHello, listener authHello, signer PublicKey, encoded string) error {
+	signature, err := decodeSignature(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !verifyHash(signer, authTranscript(tag, dialer, listener), signature) {
+		return fmt.Errorf("peer does not own the key %s", EncodePublicKey(signer))
+	}
+	return nil
+}
+
+// authenticateListener runs the handshake on a connection we dialed and
+// returns the encrypted connection and the proven public key of the peer
+func authenticateListener(conn net.Conn) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	own, ephemeral, err := newAuthHello()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := sendAuthMessage(fmt.Sprintf("AUTH_HELLO %s", own), conn); err != nil {
+		return nil, "", err
+	}
+
+	parts, err := readAuthMessage(conn, "AUTH_CHALLENGE", 4)
+	if err != nil {
+		return nil, "", err
+	}
+	peer, err := parseAuthHello(parts)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyAuth(AUTH_LISTENER_TAG, own, peer, peer.PubKey, parts[3]); err != nil {
+		return nil, "", err
+	}
+
+	signature, err := signHash(userdata.Key.Sk, authTranscript(AUTH_DIALER_TAG, own, peer))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := sendAuthMessage(fmt.Sprintf("AUTH_PROOF %s", encodeSignature(signature)), conn); err != nil {
+		return nil, "", err
+	}
+
+	secure, err := newSecureConn(conn, own, peer, ephemeral, true)
+	if err != nil {
+		return nil, "", err
+	}
+	return secure, EncodePublicKey(peer.PubKey), nil
+}
+
+// authenticateDialer runs the handshake on an accepted connection and returns
+// the encrypted connection and the proven public key of the peer
+func authenticateDialer(conn net.Conn) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	parts, err := readAuthMessage(conn, "AUTH_HELLO", 3)
+	if err != nil {
+		return nil, "", err
+	}
+	peer, err := parseAuthHello(parts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	own, ephemeral, err := newAuthHello()
+	if err != nil {
+		return nil, "", err
+	}
+	signature, err := signHash(userdata.Key.Sk, authTranscript(AUTH_LISTENER_TAG, peer, own))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := sendAuthMessage(fmt.Sprintf("AUTH_CHALLENGE %s %s", own, encodeSignature(signature)), conn); err != nil {
+		return nil, "", err
+	}
+
+	parts, err = readAuthMessage(conn, "AUTH_PROOF", 1)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyAuth(AUTH_DIALER_TAG, peer, own, peer.PubKey, parts[0]); err != nil {
+		return nil, "", err
+	}
+
+	secure, err := newSecureConn(conn, peer, own, ephemeral, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return secure, EncodePublicKey(peer.PubKey), nil
+}
@@ -0,0 +1,93 @@
+package nether
+
+import (
+	"sync"
+	"time"
+)
+
+// Faces received by the server are written in batches: one signed block holds
+// every face received within BATCH_WINDOW, up to BATCH_MAX_FACES
+const (
+	BATCH_MAX_FACES int           = 64
+	BATCH_WINDOW    time.Duration = 200 * time.Millisecond
+)
+
+type batchedFace struct {
+	embedding Embedding
+	image     Image
+	event     FaceEvent
+	done      chan error
+}
+
+var (
+	face_batch       []batchedFace
+	face_batch_timer *time.Timer
+	face_batch_lock  sync.Mutex
+)
+
+// submitFace adds a face to the current batch and waits until the block
+// holding it is written
+func submitFace(embedding Embedding, image Image, event FaceEvent) error {
+	done := make(chan error, 1)
+
+	face_batch_lock.Lock()
+	face_batch = append(face_batch, batchedFace{embedding: embedding, image: image, event: event, done: done})
+
+	var full []batchedFace
+	if len(face_batch) >= BATCH_MAX_FACES {
+		full = takeBatchLocked()
+	} else if len(face_batch) == 1 {
+		face_batch_timer = time.AfterFunc(BATCH_WINDOW, flushFaces)
+	}
+	face_batch_lock.Unlock()
+
+	if full != nil {
+		writeFaceBatch(full)
+	}
+	return <-done
+}
+
+// takeBatchLocked empties the current batch. The caller must hold face_batch_lock.
+func takeBatchLocked() []batchedFace {
+	if face_batch_timer != nil {
+		face_batch_timer.Stop()
+		face_batch_timer = nil
+	}
+
+	batch := face_batch
+	face_batch = nil
+	return batch
+}
+
+func flushFaces() {
+	face_batch_lock.Lock()
+	batch := takeBatchLocked()
+	face_batch_lock.Unlock()
+
+	if len(batch) > 0 {
+		writeFaceBatch(batch)
+	}
+}
+
+// writeFaceBatch writes the faces in a single block and reports the result to
+// every submitter. An image shared by several faces is stored once.
+func writeFaceBatch(batch []batchedFace) {
+	embeddings := make([]Embedding, 0, len(batch))
+	images := make([]Image, 0, len(batch))
+	events := make([]FaceEvent, 0, len(batch))
+	stored := make(map[Hash]bool)
+
+	for _, f := range batch {
+		embeddings = append(embeddings, f.embedding)
+		events = append(events, f.event)
+		if !stored[f.image.hash] {
+			stored[f.image.hash] = true
+			images = append(images, f.image)
+		}
+	}
+
+	err := WriteBlock(NewStorage(embeddings, images, events))
+	for _, f := range batch {
+		f.done <- err
+	}
+}
@@ -0,0 +1,65 @@
+package nether
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSubmitFaceBatchesConcurrentFaces(t *testing.T) {
+	useTestNode(t)
+
+	image, err := newImage([]byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const faces = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, faces)
+	for i := 0; i < faces; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e := testEmbedding(t, int64(i))
+			event := FaceEvent{CameraID: fmt.Sprintf("cam-%d", i), EmbeddingID: e.ID(), ImageHash: image.hash}
+			errs <- submitFace(*e, *image, event)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if last := reader.Metadata().LastBlockIndex; last != 1 {
+		t.Fatalf("faces were written in %d blocks, want 1", last)
+	}
+	b, err := reader.ReadBlockAt(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Storage.Embeddings) != faces || len(b.Storage.Events) != faces {
+		t.Errorf("block has %d embeddings and %d events, want %d", len(b.Storage.Embeddings), len(b.Storage.Events), faces)
+	}
+	if len(b.Storage.Images) != 1 {
+		t.Errorf("shared image stored %d times, want 1", len(b.Storage.Images))
+	}
+}
+
+func TestSubmitFaceWithoutChain(t *testing.T) {
+	useTempDir(t)
+
+	e := testEmbedding(t, 1)
+	image, err := newImage([]byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := submitFace(*e, *image, FaceEvent{EmbeddingID: e.ID(), ImageHash: image.hash}); err != ErrChainNotLoaded {
+		t.Fatalf("submitFace without a chain returned %v, want ErrChainNotLoaded", err)
+	}
+}
@@ -2,26 +2,48 @@ package nether
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
-	"math/big"
+	"fmt"
 	"time"
 )
 
+// Block format versions. Legacy blocks come from chains written before the
+// versioned file format and keep their original hash rule.
+const (
+	BLOCK_VERSION_LEGACY        uint8 = 0
+	BLOCK_VERSION_MERKLE        uint8 = 1
+	BLOCK_VERSION_IMAGE_HASH    uint8 = 2
+	BLOCK_VERSION_NORMALIZATION uint8 = 3
+	BLOCK_VERSION_EMBEDDING_ID  uint8 = 4
+	BLOCK_VERSION_FACE_EVENT    uint8 = 5
+	BLOCK_VERSION               uint8 = BLOCK_VERSION_FACE_EVENT
+)
+
+// BLOCK_HEADER_ONLY is set in the stored version byte of blocks kept without
+// their storage by light nodes
+const BLOCK_HEADER_ONLY uint8 = 0x80
+
 type Block struct {
-	BlockSize uint64
-	Index     uint64
-	Timestamp uint64
-	PrevHash  Hash
-	Hash      Hash
-	Signature Signature
-	PubKey    PublicKey
-	Storage   Storage
+	BlockSize  uint64
+	Version    uint8
+	Index      uint64
+	Timestamp  uint64
+	PrevHash   Hash
+	MerkleRoot Hash
+	Hash       Hash
+	Signature  Signature
+	PubKey     PublicKey
+	Storage    Storage
+	HeaderOnly bool // the storage is not kept locally, MerkleRoot commits to it
 }
 
 func (b *Block) calculateHash() {
+	if b.Version == BLOCK_VERSION_LEGACY {
+		b.calculateLegacyHash()
+		return
+	}
+
 	record := make([]byte, 0)
 	index := make([]byte, 8)
 	timestamp := make([]byte, 8)
@@ -29,104 +51,169 @@ func (b *Block) calculateHash() {
 	binary.LittleEndian.PutUint64(index, b.Index)
 	binary.LittleEndian.PutUint64(timestamp, b.Timestamp)
 
+	record = append(record, b.Version)
 	record = append(record, index...)
 	record = append(record, timestamp...)
 	record = append(record, b.PrevHash[:]...)
-
-	serializedEmbedding, _ := b.Storage.Embedding.Serialize()
-	record = append(record, serializedEmbedding...)
-
-	serializedImage, _ := b.Storage.Image.Serialize()
-	record = append(record, serializedImage...)
+	record = append(record, b.MerkleRoot[:]...)
 
 	b.Hash = sha256.Sum256(record)
 }
 
-func (b *Block) sign(Sk PrivateKey) (err error) {
-	r, s, err := ecdsa.Sign(rand.Reader, BytesToEcdsaPrivateKey(Sk), b.Hash[:])
-	if err != nil {
-		return err
+// calculateLegacyHash hashes the single embedding and image of a legacy block
+// the same way the original format did
+func (b *Block) calculateLegacyHash() {
+	record := make([]byte, 0)
+	index := make([]byte, 8)
+	timestamp := make([]byte, 8)
+
+	binary.LittleEndian.PutUint64(index, b.Index)
+	binary.LittleEndian.PutUint64(timestamp, b.Timestamp)
+
+	record = append(record, index...)
+	record = append(record, timestamp...)
+	record = append(record, b.PrevHash[:]...)
+
+	for i := range b.Storage.Embeddings {
+		serializedEmbedding, _ := b.Storage.Embeddings[i].serializeFor(BLOCK_VERSION_LEGACY)
+		record = append(record, serializedEmbedding...)
 	}
 
-	copy(b.Signature[:32], r.Bytes())
-	copy(b.Signature[32:], s.Bytes())
+	for i := range b.Storage.Images {
+		serializedImage, _ := b.Storage.Images[i].serializePath()
+		record = append(record, serializedImage...)
+	}
 
-	return nil
+	b.Hash = sha256.Sum256(record)
 }
 
-func (b *Block) Verify(Pk PublicKey) bool {
-	var r, s big.Int
-	r.SetBytes(b.Signature[:32])
-	s.SetBytes(b.Signature[32:])
+func (b *Block) sign(Sk PrivateKey) (err error) {
+	b.Signature, err = signHash(Sk, b.Hash)
+	return err
+}
 
-	return ecdsa.Verify(BytesToEcdsaPublicKey(Pk), b.Hash[:], &r, &s)
+func (b *Block) Verify(Pk PublicKey) bool {
+	return verifyHash(Pk, b.Hash, b.Signature)
 }
 
 func (b *Block) computeSize() {
 	blockSize := 8
+	version := 1
 	index := 8
 	timestamp := 8
 	prevHash := CIPHER_SIZE
+	merkleRoot := CIPHER_SIZE
 	hash := CIPHER_SIZE
 	signature := SIGNATURE_SIZE
 	pubKey := PUBLIC_KEY_SIZE
 
-	embeddingsSize := EMBEDDING_SIZE
-	imagesSize := 200
-	storageSize := embeddingsSize + imagesSize
+	storageSize := 0
+	if !b.HeaderOnly {
+		storageSize = b.Storage.computeSize(b.Version)
+	}
 
-	b.BlockSize = uint64(blockSize + index + timestamp + prevHash + hash + signature + pubKey + storageSize)
+	b.BlockSize = uint64(blockSize + version + index + timestamp + prevHash + merkleRoot + hash + signature + pubKey + storageSize)
 }
 
 func (b *Block) Serialize() []byte {
 	var buf bytes.Buffer
 
 	// Block metadata
+	version := b.Version
+	if b.HeaderOnly {
+		version |= BLOCK_HEADER_ONLY
+	}
+
 	binary.Write(&buf, binary.LittleEndian, b.BlockSize)
+	binary.Write(&buf, binary.LittleEndian, version)
 	binary.Write(&buf, binary.LittleEndian, b.Index)
 	binary.Write(&buf, binary.LittleEndian, b.Timestamp)
 
 	// Fixed size arrays
 	buf.Write(b.PrevHash[:])
+	buf.Write(b.MerkleRoot[:])
 	buf.Write(b.Hash[:])
 	buf.Write(b.Signature[:])
 	buf.Write(b.PubKey[:])
 
 	// Storage
-	buf.Write(b.Storage.Serialize())
+	if !b.HeaderOnly {
+		buf.Write(b.Storage.Serialize(b.Version))
+	}
 
 	return buf.Bytes()
 }
 
 func Deserialize(data []byte) *Block {
+	b, _ := deserializeBlock(data)
+	return b
+}
+
+func deserializeBlock(data []byte) (*Block, error) {
 	b := Block{}
 	buf := bytes.NewReader(data)
 
 	// Block metadata
 	binary.Read(buf, binary.LittleEndian, &b.BlockSize)
+	binary.Read(buf, binary.LittleEndian, &b.Version)
+	b.HeaderOnly = b.Version&BLOCK_HEADER_ONLY != 0
+	b.Version &^= BLOCK_HEADER_ONLY
+	if b.Version > BLOCK_VERSION {
+		return &b, fmt.Errorf("unsupported block version %d", b.Version)
+	}
 	binary.Read(buf, binary.LittleEndian, &b.Index)
+	// The hash of legacy blocks covers the storage, their header alone cannot be verified
+	if b.HeaderOnly && b.Version == BLOCK_VERSION_LEGACY {
+		return &b, fmt.Errorf("legacy block %d cannot be stored without its storage", b.Index)
+	}
 	binary.Read(buf, binary.LittleEndian, &b.Timestamp)
 
 	// Fixed size arrays
 	buf.Read(b.PrevHash[:])
+	buf.Read(b.MerkleRoot[:])
 	buf.Read(b.Hash[:])
 	buf.Read(b.Signature[:])
 	buf.Read(b.PubKey[:])
 
 	// Storage
-	b.Storage.Deserialize(data[len(data)-buf.Len():])
+	if b.HeaderOnly {
+		if buf.Len() != 0 {
+			return &b, fmt.Errorf("header only block %d has %d bytes of storage", b.Index, buf.Len())
+		}
+		return &b, nil
+	}
+	if err := b.Storage.Deserialize(data[len(data)-buf.Len():], b.Version); err != nil {
+		return &b, err
+	}
+
+	return &b, nil
+}
+
+// Header returns a copy of the block without its storage, as kept by light
+// nodes. Legacy blocks are returned whole since their header cannot be verified alone.
+func (b *Block) Header() *Block {
+	if b.Version == BLOCK_VERSION_LEGACY {
+		return b
+	}
+
+	header := *b
+	header.Storage = Storage{}
+	header.HeaderOnly = true
+	header.computeSize()
 
-	return &b
+	return &header
 }
 
 func NewBlock(oldBlock *Block, k Key, store Storage) (*Block, error) {
 	newBlock := &Block{
-		BlockSize: 0,
-		Index:     oldBlock.Index + 1,
-		Timestamp: uint64(time.Now().Unix()),
-		PrevHash:  oldBlock.Hash,
-		PubKey:    k.Pk,
-		Storage:   store,
+		BlockSize:  0,
+		Version:    BLOCK_VERSION,
+		Index:      oldBlock.Index + 1,
+		Timestamp:  uint64(time.Now().Unix()),
+		PrevHash:   oldBlock.Hash,
+		MerkleRoot: store.merkleRoot(BLOCK_VERSION),
+		PubKey:     k.Pk,
+		Storage:    store,
 	}
 
 	newBlock.calculateHash()
@@ -143,6 +230,7 @@ func NewBlock(oldBlock *Block, k Key, store Storage) (*Block, error) {
 func NewGenesis(k Key, genesisHash Hash) *Block {
 	genesis := &Block{
 		BlockSize: 0,
+		Version:   BLOCK_VERSION,
 		Index:     0,
 		Timestamp: uint64(time.Now().Unix()),
 		PrevHash:  genesisHash,
@@ -0,0 +1,92 @@
+package nether
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Filter selects the blocks visited by Chain.Iterate. Zero values leave a
+// bound open: a nil ToIndex iterates to the last block and a zero time does
+// not limit the block timestamps.
+type Filter struct {
+	FromIndex    uint64
+	ToIndex      *uint64 // inclusive
+	FromTime     time.Time
+	ToTime       time.Time
+	SignerPubKey *PublicKey
+}
+
+// match checks the fields of b that do not depend on its height
+func (f *Filter) match(b *Block) bool {
+	timestamp := time.Unix(int64(b.Timestamp), 0)
+	if !f.FromTime.IsZero() && timestamp.Before(f.FromTime) {
+		return false
+	}
+	if !f.ToTime.IsZero() && timestamp.After(f.ToTime) {
+		return false
+	}
+	if f.SignerPubKey != nil && b.PubKey != *f.SignerPubKey {
+		return false
+	}
+	return true
+}
+
+// Chain is a read view of a blockchain for code that walks ranges of blocks
+type Chain struct {
+	store ChainStore
+}
+
+func NewChain(s ChainStore) *Chain {
+	return &Chain{store: s}
+}
+
+// Iterate calls yield for every committed block matching f, in height order.
+// Blocks are read one at a time; the iteration stops when yield returns
+// false, after ToIndex, or when ctx is done, in which case ctx.Err() is
+// returned.
+func (c *Chain) Iterate(ctx context.Context, f Filter, yield func(b *Block) bool) error {
+	var ctxErr error
+	err := c.store.Scan(f.FromIndex, func(b *Block) bool {
+		if ctxErr = ctx.Err(); ctxErr != nil {
+			return false
+		}
+		if f.ToIndex != nil && b.Index > *f.ToIndex {
+			return false
+		}
+		if !f.match(b) {
+			return true
+		}
+		return yield(b)
+	})
+
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// FindByEmbeddingID scans the chain for the embedding with the given ID and
+// returns its block and position in the block storage
+func (c *Chain) FindByEmbeddingID(ctx context.Context, id Hash) (*Block, int, error) {
+	var found *Block
+	position := 0
+
+	err := c.Iterate(ctx, Filter{}, func(b *Block) bool {
+		for i := range b.Storage.Embeddings {
+			if b.Storage.Embeddings[i].id == id {
+				found, position = b, i
+				return false
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	if found == nil {
+		return nil, 0, fmt.Errorf("embedding %x not found", id)
+	}
+	return found, position, nil
+}
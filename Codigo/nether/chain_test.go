@@ -0,0 +1,101 @@
+package nether
+
+import (
+	"context"
+	"testing"
+)
+
+// fillStore appends n blocks signed by k, with the signer of odd heights changed to other
+func fillStore(t *testing.T, s ChainStore, k Key, other Key, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		e := testEmbedding(t, int64(i))
+		_, err := s.Append(func(last *Block) (*Block, error) {
+			signer := k
+			if (last.Index+1)%2 == 1 {
+				signer = other
+			}
+			return NewBlock(last, signer, *NewStorage([]Embedding{*e}, nil, nil))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func heightPtr(h uint64) *uint64 {
+	return &h
+}
+
+func TestChainIterateFilters(t *testing.T) {
+	useTempDir(t)
+
+	k, other := *NewKey(), *NewKey()
+	file, err := CreateBlockchain(BLOCKCHAIN_PATH, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stores := map[string]ChainStore{"file": file, "memory": NewMemoryStore(k)}
+	for _, s := range stores {
+		fillStore(t, s, k, other, 6)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []uint64
+	}{
+		{"everything", Filter{}, []uint64{0, 1, 2, 3, 4, 5, 6}},
+		{"genesis only", Filter{FromIndex: 0, ToIndex: heightPtr(0)}, []uint64{0}},
+		{"range", Filter{FromIndex: 2, ToIndex: heightPtr(4)}, []uint64{2, 3, 4}},
+		{"open end", Filter{FromIndex: 5}, []uint64{5, 6}},
+		{"past the last block", Filter{FromIndex: 3, ToIndex: heightPtr(100)}, []uint64{3, 4, 5, 6}},
+		{"empty range", Filter{FromIndex: 4, ToIndex: heightPtr(3)}, nil},
+		{"signer", Filter{FromIndex: 1, SignerPubKey: &other.Pk}, []uint64{1, 3, 5}},
+	}
+
+	for name, s := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				var got []uint64
+				err := NewChain(s).Iterate(context.Background(), tt.filter, func(b *Block) bool {
+					got = append(got, b.Index)
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(got) != len(tt.want) {
+					t.Fatalf("visited %v, want %v", got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("visited %v, want %v", got, tt.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestChainIterateStopsWithContext(t *testing.T) {
+	k := *NewKey()
+	s := NewMemoryStore(k)
+	fillStore(t, s, k, k, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err := NewChain(s).Iterate(ctx, Filter{}, func(b *Block) bool {
+		visited++
+		cancel()
+		return true
+	})
+
+	if err != context.Canceled || visited != 1 {
+		t.Fatalf("Iterate returned %v after %d blocks, want context.Canceled after 1", err, visited)
+	}
+}
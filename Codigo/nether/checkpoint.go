@@ -0,0 +1,296 @@
+package nether
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Checkpoints let a new node trust the chain up to a height signed by the
+// leaders instead of downloading and verifying the whole history first
+const (
+	CHECKPOINT_PATH     string        = "data/nether.checkpoint"
+	CHECKPOINT_MAGIC    string        = "NTCP"
+	CHECKPOINT_INTERVAL uint64        = 100
+	CHECKPOINT_PERIOD   time.Duration = 5 * time.Minute
+	CHECKPOINT_QUORUM   int           = 2
+
+	// LEADERS_PATH lists the public keys of the leaders whose signatures
+	// count towards the quorum, one per line as printed by EncodePublicKey
+	LEADERS_PATH string = "data/nether.leaders"
+)
+
+type CheckpointSignature struct {
+	PubKey    PublicKey
+	Signature Signature
+}
+
+// Checkpoint commits to the block at Height and to every block before it:
+// StateHash folds the hashes of all blocks since the genesis
+type Checkpoint struct {
+	Height     uint64
+	BlockHash  Hash
+	StateHash  Hash
+	Signatures []CheckpointSignature
+}
+
+// nextStateHash extends the cumulative state hash with the next block
+func nextStateHash(state Hash, blockHash Hash) Hash {
+	return sha256.Sum256(append(state[:], blockHash[:]...))
+}
+
+// digest is the message signed by the leaders
+func (c *Checkpoint) digest() Hash {
+	var buf bytes.Buffer
+	buf.WriteString(CHECKPOINT_MAGIC)
+	binary.Write(&buf, binary.LittleEndian, c.Height)
+	buf.Write(c.BlockHash[:])
+	buf.Write(c.StateHash[:])
+
+	return sha256.Sum256(buf.Bytes())
+}
+
+func (c *Checkpoint) signedBy(pk PublicKey) bool {
+	for i := range c.Signatures {
+		if c.Signatures[i].PubKey == pk {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checkpoint) sign(k Key) error {
+	if c.signedBy(k.Pk) {
+		return nil
+	}
+
+	signature, err := signHash(k.Sk, c.digest())
+	if err != nil {
+		return err
+	}
+
+	c.Signatures = append(c.Signatures, CheckpointSignature{PubKey: k.Pk, Signature: signature})
+	return nil
+}
+
+// validSigners counts the distinct trusted keys with a valid signature
+func (c *Checkpoint) validSigners(trusted map[PublicKey]bool) int {
+	digest := c.digest()
+	seen := make(map[PublicKey]bool)
+	for i := range c.Signatures {
+		pk := c.Signatures[i].PubKey
+		if trusted[pk] && !seen[pk] && verifyHash(pk, digest, c.Signatures[i].Signature) {
+			seen[pk] = true
+		}
+	}
+	return len(seen)
+}
+
+// merge adds the valid signatures of trusted keys in other for the same
+// checkpoint, returning true when a new signature was added
+func (c *Checkpoint) merge(other *Checkpoint, trusted map[PublicKey]bool) bool {
+	digest := c.digest()
+	if other.digest() != digest {
+		return false
+	}
+
+	changed := false
+	for _, s := range other.Signatures {
+		if trusted[s.PubKey] && !c.signedBy(s.PubKey) && verifyHash(s.PubKey, digest, s.Signature) {
+			c.Signatures = append(c.Signatures, s)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (c *Checkpoint) Serialize() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(CHECKPOINT_MAGIC)
+	binary.Write(&buf, binary.LittleEndian, c.Height)
+	buf.Write(c.BlockHash[:])
+	buf.Write(c.StateHash[:])
+	binary.Write(&buf, binary.LittleEndian, uint16(len(c.Signatures)))
+	for _, s := range c.Signatures {
+		buf.Write(s.PubKey[:])
+		buf.Write(s.Signature[:])
+	}
+
+	return buf.Bytes()
+}
+
+func deserializeCheckpoint(data []byte) (*Checkpoint, error) {
+	buf := bytes.NewReader(data)
+
+	magic := make([]byte, len(CHECKPOINT_MAGIC))
+	if _, err := io.ReadFull(buf, magic); err != nil || string(magic) != CHECKPOINT_MAGIC {
+		return nil, fmt.Errorf("invalid checkpoint")
+	}
+
+	c := &Checkpoint{}
+	var count uint16
+	binary.Read(buf, binary.LittleEndian, &c.Height)
+	io.ReadFull(buf, c.BlockHash[:])
+	io.ReadFull(buf, c.StateHash[:])
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("truncated checkpoint: %w", err)
+	}
+
+	c.Signatures = make([]CheckpointSignature, count)
+	for i := range c.Signatures {
+		io.ReadFull(buf, c.Signatures[i].PubKey[:])
+		if _, err := io.ReadFull(buf, c.Signatures[i].Signature[:]); err != nil {
+			return nil, fmt.Errorf("truncated checkpoint signature %d: %w", i, err)
+		}
+	}
+
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after checkpoint", buf.Len())
+	}
+	return c, nil
+}
+
+// trustedLeaders returns the keys listed in LEADERS_PATH, the only ones whose
+// checkpoint signatures count towards the quorum. Connected leaders are not
+// trusted on their own: any peer can claim the role.
+func trustedLeaders() (map[PublicKey]bool, error) {
+	keys, err := readLeaders()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted leader in %s, add them with trust leader", LEADERS_PATH)
+	}
+
+	trusted := make(map[PublicKey]bool, len(keys))
+	for _, pk := range keys {
+		trusted[pk] = true
+	}
+	return trusted, nil
+}
+
+// readLeaders reads the keys in LEADERS_PATH, returning nil when there is no such file
+func readLeaders() ([]PublicKey, error) {
+	data, err := os.ReadFile(LEADERS_PATH)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]PublicKey, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pk, err := DecodePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", LEADERS_PATH, i+1, err)
+		}
+		keys = append(keys, pk)
+	}
+	return keys, nil
+}
+
+// TrustLeader adds the public key of a leader to LEADERS_PATH. Only the
+// signatures of the leaders listed in it count towards the checkpoint quorum,
+// so fast sync needs at least as many of them as the quorum.
+func TrustLeader(key string) error {
+	pk, err := DecodePublicKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	keys, err := readLeaders()
+	if err != nil {
+		return err
+	}
+	for _, known := range keys {
+		if known == pk {
+			return nil
+		}
+	}
+
+	file, err := os.OpenFile(LEADERS_PATH, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", LEADERS_PATH, err)
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, EncodePublicKey(pk))
+	return err
+}
+
+// loadCheckpoint reads the stored checkpoint, returning nil when there is none
+func loadCheckpoint() (*Checkpoint, error) {
+	data, err := os.ReadFile(CHECKPOINT_PATH)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint: %w", err)
+	}
+	return deserializeCheckpoint(data)
+}
+
+func saveCheckpoint(c *Checkpoint) error {
+	tmpPath := CHECKPOINT_PATH + ".tmp"
+	if err := os.WriteFile(tmpPath, c.Serialize(), 0644); err != nil {
+		return fmt.Errorf("cannot save checkpoint: %w", err)
+	}
+	return os.Rename(tmpPath, CHECKPOINT_PATH)
+}
+
+// checkpointAt computes the unsigned checkpoint of the block at height of s.
+// The state hash is folded from the genesis, or from trusted when the history
+// before it is not stored locally.
+func checkpointAt(s ChainStore, height uint64, trusted *Checkpoint) (*Checkpoint, error) {
+	metadata := s.Metadata()
+	base := metadata.BaseIndex
+	if metadata.Size == 0 || height > metadata.LastBlockIndex {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+
+	c := &Checkpoint{Height: height}
+	state := metadata.FirstBlockHash
+	from := base
+
+	switch {
+	case trusted != nil && trusted.Height >= base && trusted.Height <= height:
+		b, err := s.ReadBlockAt(trusted.Height)
+		if err != nil {
+			return nil, err
+		}
+		if b.Hash != trusted.BlockHash {
+			return nil, fmt.Errorf("block %d does not match the trusted checkpoint", trusted.Height)
+		}
+		if trusted.Height == height {
+			c.BlockHash, c.StateHash = trusted.BlockHash, trusted.StateHash
+			return c, nil
+		}
+		state, from = trusted.StateHash, trusted.Height+1
+	case base > 0:
+		return nil, fmt.Errorf("history before block %d is not stored locally", base)
+	}
+
+	err := NewChain(s).Iterate(context.Background(), Filter{FromIndex: from}, func(b *Block) bool {
+		state = nextStateHash(state, b.Hash)
+		c.BlockHash = b.Hash
+		return b.Index < height
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.StateHash = state
+	return c, nil
+}
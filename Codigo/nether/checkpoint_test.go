@@ -0,0 +1,168 @@
+package nether
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func signedCheckpoint(t *testing.T, height uint64, signers ...Key) *Checkpoint {
+	t.Helper()
+
+	c := &Checkpoint{Height: height, BlockHash: Hash{byte(height)}, StateHash: Hash{1}}
+	for _, k := range signers {
+		if err := c.sign(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestValidSignersCountsOnlyTrustedKeys(t *testing.T) {
+	a, b, outsider, forger := *NewKey(), *NewKey(), *NewKey(), *NewKey()
+	c := signedCheckpoint(t, 100, a, b, outsider)
+
+	// A repeated signature and one claimed by a trusted key it does not verify under
+	c.Signatures = append(c.Signatures, c.Signatures[0])
+	c.Signatures = append(c.Signatures, CheckpointSignature{PubKey: forger.Pk, Signature: c.Signatures[0].Signature})
+
+	trusted := map[PublicKey]bool{a.Pk: true, b.Pk: true, forger.Pk: true}
+	if got := c.validSigners(trusted); got != 2 {
+		t.Fatalf("validSigners() = %d, want 2", got)
+	}
+	if got := c.validSigners(nil); got != 0 {
+		t.Fatalf("validSigners() without trusted keys = %d, want 0", got)
+	}
+}
+
+func TestMergeIgnoresUntrustedSignatures(t *testing.T) {
+	a, b, outsider := *NewKey(), *NewKey(), *NewKey()
+	trusted := map[PublicKey]bool{a.Pk: true, b.Pk: true}
+
+	c := signedCheckpoint(t, 100, a)
+	if c.merge(signedCheckpoint(t, 100, outsider), trusted) {
+		t.Fatal("merged the signature of an untrusted key")
+	}
+	if !c.merge(signedCheckpoint(t, 100, b, outsider), trusted) {
+		t.Fatal("did not merge the signature of a trusted key")
+	}
+	if len(c.Signatures) != 2 || c.signedBy(outsider.Pk) {
+		t.Fatalf("checkpoint has %d signatures after merging, want those of the 2 trusted keys", len(c.Signatures))
+	}
+	if c.merge(signedCheckpoint(t, 200, b), trusted) {
+		t.Fatal("merged the signature of another checkpoint")
+	}
+}
+
+func TestTrustLeader(t *testing.T) {
+	useTempDir(t)
+	a, b := *NewKey(), *NewKey()
+
+	if _, err := trustedLeaders(); err == nil {
+		t.Fatal("trusted leaders without a leaders file")
+	}
+
+	for _, k := range []Key{a, a, b} {
+		if err := TrustLeader(EncodePublicKey(k.Pk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := TrustLeader("not a key"); err == nil {
+		t.Fatal("trusted an invalid key")
+	}
+
+	trusted, err := trustedLeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trusted) != 2 || !trusted[a.Pk] || !trusted[b.Pk] {
+		t.Fatalf("trusted %d keys, want the 2 listed", len(trusted))
+	}
+
+	if err := os.WriteFile(LEADERS_PATH, []byte("# leaders\ninvalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readLeaders(); err == nil {
+		t.Fatal("read an invalid leaders file")
+	}
+}
+
+func TestLatestCheckpoint(t *testing.T) {
+	a, b, outsider := *NewKey(), *NewKey(), *NewKey()
+	trusted := map[PublicKey]bool{a.Pk: true, b.Pk: true}
+
+	replies := []checkpointReply{
+		{checkpoint: signedCheckpoint(t, 100, a, b)},
+		{checkpoint: signedCheckpoint(t, 300, a, outsider)},
+		{checkpoint: signedCheckpoint(t, 200, b, a)},
+		{checkpoint: signedCheckpoint(t, 150, a, b)},
+	}
+
+	latest := latestCheckpoint(replies, 2, trusted)
+	if latest == nil || latest.checkpoint.Height != 200 {
+		t.Fatalf("picked %v, want the checkpoint of block 200", latest)
+	}
+	if latest := latestCheckpoint(replies, 3, trusted); latest != nil {
+		t.Fatalf("picked the checkpoint of block %d without quorum", latest.checkpoint.Height)
+	}
+}
+
+func TestFastSyncRequiresTrustedLeaders(t *testing.T) {
+	useTestNode(t)
+	useLeaderPipe(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+
+	// The connected leader is not trusted on its own
+	err := FastSync(ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), LEADERS_PATH) {
+		t.Fatalf("FastSync() = %v, want an error about %s", err, LEADERS_PATH)
+	}
+
+	if err := TrustLeader(EncodePublicKey(userdata.Key.Pk)); err != nil {
+		t.Fatal(err)
+	}
+	if err := FastSync(ctx, CHECKPOINT_QUORUM); err == nil || !strings.Contains(err.Error(), "cannot be reached") {
+		t.Fatalf("FastSync() = %v, want an unreachable quorum error", err)
+	}
+}
+
+func TestDropSyncedChain(t *testing.T) {
+	useTestNode(t)
+	t.Cleanup(func() { checkpoint = nil })
+
+	k := *NewKey()
+	installed := signedCheckpoint(t, 100, k)
+	checkpoint = installed
+	if err := saveCheckpoint(installed); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later sync replaced the chain and its checkpoint
+	if err := dropSyncedChain(signedCheckpoint(t, 200, k)); err != nil {
+		t.Fatal(err)
+	}
+	_, done, err := loadedChain()
+	if err != nil {
+		t.Fatal("dropped a chain installed from another checkpoint")
+	}
+	done()
+
+	if err := dropSyncedChain(installed); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadedChain(); !errors.Is(err, ErrChainNotLoaded) {
+		t.Fatalf("loadedChain() = %v, want %v", err, ErrChainNotLoaded)
+	}
+	for _, path := range []string{BLOCKCHAIN_PATH, BLOCKCHAIN_PATH + INDEX_SUFFIX, CHECKPOINT_PATH} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", path)
+		}
+	}
+	if currentCheckpoint() != nil {
+		t.Error("checkpoint was kept")
+	}
+}
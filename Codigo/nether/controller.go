@@ -1,9 +1,13 @@
 package nether
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 )
 
 const (
@@ -12,9 +16,19 @@ const (
 
 var (
 	userdata *UserData
-	reader   *NetherReader
+
+	// reader is the loaded chain. It is only closed or replaced holding the
+	// write lock, users hold the read lock while they use it, see loadedChain.
+	reader      ChainStore
+	reader_lock sync.RWMutex
 )
 
+// ErrChainNotLoaded is returned when a block is written before loading or creating the blockchain
+var ErrChainNotLoaded = errors.New("blockchain not loaded")
+
+// errNotChainFile is returned by the operations that only make sense for a chain stored in a file
+var errNotChainFile = errors.New("the loaded blockchain is not stored in a file")
+
 func Start() {
 	initHandlers()
 }
@@ -34,8 +48,15 @@ func StartLog() {
 	log.Println("Iniciando o programa...")
 }
 
-func Register(password string) {
-	userdata = register(password)
+// Register creates the identity name in the keystore and logs in as it
+func Register(name string, password string) error {
+	m, err := register(name, password)
+	if err != nil {
+		return err
+	}
+
+	userdata = m
+	return nil
 }
 
 func GetUserdata() string {
@@ -46,17 +67,272 @@ func ResetUserdata() {
 	userdata = &UserData{}
 }
 
-func LoadData(password string) (success bool) {
-	success, userdata = LoadConfig(password)
+// LoadData logs in as the identity name, the default identity when name is empty
+func LoadData(name string, password string) (success bool) {
+	success, userdata = LoadConfig(name, password)
 	return
 }
 
+// CurrentIdentity returns the name of the logged identity
+func CurrentIdentity() string {
+	if userdata == nil {
+		return ""
+	}
+	return userdata.Name
+}
+
+// ListIdentities returns the identities in the keystore and the default one
+func ListIdentities() ([]string, string, error) {
+	return identities()
+}
+
+// SetDefaultIdentity chooses the identity the node runs as when none is named at login
+func SetDefaultIdentity(name string) error {
+	return setDefaultIdentity(name)
+}
+
+// ChangePassword re-encrypts the keystore of the logged user with a new password
+func ChangePassword(oldPassword string, newPassword string) error {
+	if userdata == nil || userdata.Key.Sk == (PrivateKey{}) {
+		return fmt.Errorf("no user logged in")
+	}
+	if success, _ := LoadConfig(userdata.Name, oldPassword); !success {
+		return fmt.Errorf("wrong password")
+	}
+
+	updated := *userdata
+	updated.kdf = newKdfParams()
+	updated.Hash = updated.kdf.deriveKey(newPassword)
+	if err := SaveConfig(&updated); err != nil {
+		return err
+	}
+
+	userdata.kdf, userdata.Hash = updated.kdf, updated.Hash
+	return nil
+}
+
+// ExportKey writes the key of the logged user to path as a PEM backup encrypted with password
+func ExportKey(path string, password string) error {
+	if userdata == nil || userdata.Key.Sk == (PrivateKey{}) {
+		return fmt.Errorf("no user logged in")
+	}
+
+	data, err := marshalKeyBackup(userdata.Key, password)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// ImportKey adds the key in the PEM backup at path, encrypted with
+// backupPassword, to the keystore as the new identity name protected by
+// password. It fails when the identity already exists.
+func ImportKey(path string, backupPassword string, name string, password string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read key backup: %w", err)
+	}
+	k, err := parseKeyBackup(data, backupPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = addIdentity(name, password, *k)
+	return err
+}
+
 func NewBlockchain() {
-	reader, _ = newBlockchain(userdata.Key)
+	err := replaceChain(func() (ChainStore, error) {
+		return newBlockchain(userdata.Key)
+	})
+	if err != nil {
+		fmt.Printf("cannot create blockchain: %v\n", err)
+	}
+}
+
+// NewMemoryBlockchain creates a chain kept only in memory, lost when the node stops
+func NewMemoryBlockchain() {
+	UseChainStore(NewMemoryStore(userdata.Key))
 }
 
 func LoadBlockchain() {
-	reader, _ = NewReader()
+	err := replaceChain(func() (ChainStore, error) {
+		return NewReader()
+	})
+	if err != nil {
+		fmt.Printf("cannot load blockchain: %v\n", err)
+	}
+}
+
+// UseChainStore makes s the loaded chain, closing the previous one
+func UseChainStore(s ChainStore) error {
+	return replaceChain(func() (ChainStore, error) {
+		return s, nil
+	})
+}
+
+// replaceChain closes the loaded chain, once no one is using it, and loads the
+// one returned by open. Files of the old chain can be replaced inside open.
+func replaceChain(open func() (ChainStore, error)) error {
+	reader_lock.Lock()
+	defer reader_lock.Unlock()
+
+	if reader != nil {
+		reader.Close()
+		reader = nil
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	reader = s
+	return nil
+}
+
+// loadedChain returns the loaded chain, which is not closed or replaced until
+// done is called. done must not be called twice, and loadedChain must not be
+// called again before it.
+func loadedChain() (s ChainStore, done func(), err error) {
+	reader_lock.RLock()
+	if reader == nil {
+		reader_lock.RUnlock()
+		return nil, nil, ErrChainNotLoaded
+	}
+	return reader, reader_lock.RUnlock, nil
+}
+
+// localReader returns the loaded chain, which is safe to share, or opens a
+// dedicated reader of the chain file when the blockchain was not loaded. done
+// must be called when the caller is finished with it.
+func localReader() (s ChainStore, done func(), err error) {
+	if s, done, err := loadedChain(); err == nil {
+		return s, done, nil
+	}
+
+	r, err := NewReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open blockchain: %w", err)
+	}
+	return r, func() { r.Close() }, nil
+}
+
+// IterateChain calls yield for the blocks of the local chain matching f
+func IterateChain(ctx context.Context, f Filter, yield func(b *Block) bool) error {
+	r, done, err := localReader()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return NewChain(r).Iterate(ctx, f, yield)
+}
+
+// ReadBlockAt reads the block at the given height of the local chain
+func ReadBlockAt(index uint64) (*Block, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return r.ReadBlockAt(index)
+}
+
+// ReadBlockByHash reads the block with the given hash from the local chain
+func ReadBlockByHash(hash Hash) (*Block, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return r.ReadBlockByHash(hash)
+}
+
+// RebuildIndex rewrites the block index of the local chain
+func RebuildIndex() error {
+	r, done, err := localReader()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	file, ok := r.(*NetherReader)
+	if !ok {
+		return errNotChainFile
+	}
+	return file.RebuildIndex()
+}
+
+// FindByEmbeddingID looks up the block holding the embedding with the given ID
+func FindByEmbeddingID(id Hash) (*Block, int, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer done()
+
+	return NewChain(r).FindByEmbeddingID(context.Background(), id)
+}
+
+// ExportChain returns the local chain as a single unsegmented chain file
+func ExportChain() ([]byte, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var buf bytes.Buffer
+	if err := r.Export(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// VerifySegments checks the sealed segments of the local chain against the
+// manifest and returns the ones moved to cold storage
+func VerifySegments() ([]string, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	file, ok := r.(*NetherReader)
+	if !ok {
+		return nil, errNotChainFile
+	}
+	return file.VerifySegments()
+}
+
+// VerifyImages checks the images of the local chain against the image database
+// and returns the hashes of the images that are not stored locally
+func VerifyImages() ([]Hash, error) {
+	r, done, err := localReader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return verifyImages(r)
+}
+
+// MigrateChain rewrites a legacy local chain into the current file format
+func MigrateChain() (bool, error) {
+	return migrateChain(BLOCKCHAIN_PATH)
+}
+
+// VerifyChain checks hashes, links and signatures of every block in the local chain
+func VerifyChain() error {
+	r, done, err := localReader()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return r.Verify()
 }
 
 /* func WriteRandomBlock() {
@@ -72,7 +348,7 @@ func LoadBlockchain() {
 			data[j] = float64(j + 1)
 		}
 
-		tmp, _ := newEmbedding(data)
+		tmp, _ := newEmbedding(data, true)
 		embeddings[i] = *tmp
 	}
 
@@ -87,22 +363,46 @@ func LoadBlockchain() {
 		images[i] = *img
 	}
 
-	WriteBlock(NewStorage(embeddings, images))
+	WriteBlock(NewStorage(embeddings, images, nil))
 } */
 
-func WriteBlock(storage *Storage) {
-	b, _ := NewBlock(reader.ReadLastBlock(), userdata.Key, *storage)
-	reader.WriteBlock(b)
+// WriteBlock signs a block with storage on top of the local chain
+func WriteBlock(storage *Storage) error {
+	r, done, err := loadedChain()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	_, err = r.Append(func(last *Block) (*Block, error) {
+		return NewBlock(last, userdata.Key, *storage)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write block: %w", err)
+	}
+	return nil
 }
 
 func PrintBlockchain() {
+	r, done, err := loadedChain()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	defer done()
+
 	fmt.Printf("Metadata:\n")
-	fmt.Printf("%v\n", reader)
-	reader.ReadGenesis()
-	fmt.Printf("Genesis:\n")
-	fmt.Printf("%v\n", reader.current)
-	for reader.ReadNext() {
-		fmt.Printf("Block [%03d]:\n", reader.current.Index)
-		fmt.Printf("%s\n", reader.current)
+	fmt.Printf("%v\n", r)
+	err = NewChain(r).Iterate(context.Background(), Filter{}, func(b *Block) bool {
+		if b.Index == 0 {
+			fmt.Printf("Genesis:\n")
+		} else {
+			fmt.Printf("Block [%03d]:\n", b.Index)
+		}
+		fmt.Printf("%s\n", b)
+		return true
+	})
+	if err != nil {
+		fmt.Printf("Erro ao ler blockchain: %v\n", err)
 	}
 }
@@ -34,17 +34,52 @@ func NewKey() *Key {
 		panic(fmt.Sprintf("falha ao gerar o par de chaves: %v", err))
 	}
 
-	copy(k.Sk[:], privateKey.D.Bytes())
-	copy(k.Pk[:32], privateKey.PublicKey.X.Bytes())
-	copy(k.Pk[32:], privateKey.PublicKey.Y.Bytes())
+	privateKey.D.FillBytes(k.Sk[:])
+	privateKey.PublicKey.X.FillBytes(k.Pk[:32])
+	privateKey.PublicKey.Y.FillBytes(k.Pk[32:])
 
 	return k
 }
 
+// repair checks that Pk is the public key of Sk. Keys generated before NewKey
+// padded its fields have the significant bytes of a short scalar or
+// coordinate at the start of the field, followed by zeros. Such a key is
+// rewritten in the padded layout and repair returns true. It fails when Sk
+// and Pk do not match in either layout.
+func (k *Key) repair() (bool, error) {
+	for shift := 0; shift < SECRET_KEY_SIZE && (shift == 0 || k.Sk[SECRET_KEY_SIZE-shift] == 0); shift++ {
+		var sk PrivateKey
+		new(big.Int).SetBytes(k.Sk[:SECRET_KEY_SIZE-shift]).FillBytes(sk[:])
+		x, y := elliptic.P256().ScalarBaseMult(sk[:])
+
+		var pk, unpadded PublicKey
+		x.FillBytes(pk[:32])
+		y.FillBytes(pk[32:])
+		copy(unpadded[:32], x.Bytes())
+		copy(unpadded[32:], y.Bytes())
+
+		if k.Pk != pk && k.Pk != unpadded {
+			continue
+		}
+		if k.Sk == sk && k.Pk == pk {
+			return false, nil
+		}
+		k.Sk, k.Pk = sk, pk
+		return true, nil
+	}
+
+	return false, fmt.Errorf("public key does not match the private key")
+}
+
 func BytesToEcdsaPrivateKey(keyBytes PrivateKey) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(keyBytes[:])
+
 	return &ecdsa.PrivateKey{
 		PublicKey: ecdsa.PublicKey{
-			Curve: elliptic.P256(),
+			Curve: curve,
+			X:     x,
+			Y:     y,
 		},
 		D: new(big.Int).SetBytes(keyBytes[:]),
 	}
@@ -58,6 +93,30 @@ func BytesToEcdsaPublicKey(keyBytes PublicKey) *ecdsa.PublicKey {
 	}
 }
 
+// signHash signs a digest with Sk, encoding r and s as fixed size big endian halves
+func signHash(Sk PrivateKey, hash Hash) (Signature, error) {
+	var signature Signature
+
+	r, s, err := ecdsa.Sign(rand.Reader, BytesToEcdsaPrivateKey(Sk), hash[:])
+	if err != nil {
+		return signature, err
+	}
+
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signature, nil
+}
+
+func verifyHash(Pk PublicKey, hash Hash, signature Signature) bool {
+	var r, s big.Int
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
+
+	return ecdsa.Verify(BytesToEcdsaPublicKey(Pk), hash[:], &r, &s)
+}
+
+// HashPassword is the unsalted key of the legacy keystore format, kept to read old files
 func HashPassword(password string) [32]byte {
 	return sha256.Sum256([]byte(password))
 }
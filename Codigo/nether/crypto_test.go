@@ -0,0 +1,58 @@
+package nether
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+// legacyKey generates a key whose scalar has a leading zero byte and lays it
+// out like NewKey did before padding its fields
+func legacyKey(t *testing.T) (legacy Key, padded Key) {
+	t.Helper()
+
+	for {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if privateKey.D.BitLen() > 248 {
+			continue
+		}
+
+		copy(legacy.Sk[:], privateKey.D.Bytes())
+		copy(legacy.Pk[:32], privateKey.X.Bytes())
+		copy(legacy.Pk[32:], privateKey.Y.Bytes())
+
+		privateKey.D.FillBytes(padded.Sk[:])
+		privateKey.X.FillBytes(padded.Pk[:32])
+		privateKey.Y.FillBytes(padded.Pk[32:])
+		return legacy, padded
+	}
+}
+
+func TestRepairKey(t *testing.T) {
+	k := *NewKey()
+	if repaired, err := k.repair(); err != nil || repaired {
+		t.Fatalf("padded key: repaired %v, err %v", repaired, err)
+	}
+
+	legacy, padded := legacyKey(t)
+	repaired, err := legacy.repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repaired || legacy != padded {
+		t.Fatal("unpadded key was not rewritten in the padded layout")
+	}
+
+	if b := NewGenesis(legacy, Hash{}); !b.Verify(legacy.Pk) {
+		t.Error("block signed with the repaired key does not verify")
+	}
+
+	mismatched := Key{Sk: NewKey().Sk, Pk: NewKey().Pk}
+	if _, err := mismatched.repair(); err == nil {
+		t.Error("key with a foreign public key was accepted")
+	}
+}
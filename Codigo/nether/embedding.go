@@ -2,25 +2,59 @@ package nether
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math/big"
+	"math"
 )
 
 const (
-	EMBEDDING_SIZE = (128 * 8) + 32
+	EMBEDDING_DIMENSIONS  = 128
+	EMBEDDING_SIZE        = 32 + 1 + (EMBEDDING_DIMENSIONS * 8)
+	EMBEDDING_LEGACY_SIZE = 32 + (EMBEDDING_DIMENSIONS * 8)
+)
+
+// Model that produces the embeddings sent by the camera application
+const (
+	EMBEDDING_MODEL string = "facenet-qmul"
+)
+
+// Normalizations applied to an embedding before it is stored
+const (
+	NORMALIZATION_NONE uint8 = 0
+	NORMALIZATION_L2   uint8 = 1
 )
 
 type Embedding struct {
-	id   [32]byte
-	data [128]float64
+	id            [32]byte
+	normalization uint8
+	data          [EMBEDDING_DIMENSIONS]float64
 }
 
+// generateId hashes the model metadata and the little-endian encoding of
+// every component, so equal vectors always share an ID and different ones don't
 func (e *Embedding) generateId() {
-	embeddingStr := fmt.Sprintf("%v", e)
-	e.id = sha256.Sum256([]byte(embeddingStr))
+	buffer := new(bytes.Buffer)
+
+	buffer.WriteByte(byte(len(EMBEDDING_MODEL)))
+	buffer.WriteString(EMBEDDING_MODEL)
+	binary.Write(buffer, binary.LittleEndian, uint16(EMBEDDING_DIMENSIONS))
+	binary.Write(buffer, binary.LittleEndian, e.normalization)
+
+	for _, v := range e.data {
+		// -0 and +0 are the same component
+		if v == 0 {
+			v = 0
+		}
+		binary.Write(buffer, binary.LittleEndian, math.Float64bits(v))
+	}
+
+	e.id = sha256.Sum256(buffer.Bytes())
+}
+
+// ID returns the content identifier of the embedding
+func (e *Embedding) ID() Hash {
+	return e.id
 }
 
 func (e *Embedding) Serialize() ([]byte, error) {
@@ -30,6 +64,10 @@ func (e *Embedding) Serialize() ([]byte, error) {
 		return nil, fmt.Errorf("erro ao serializar ID: %v", err)
 	}
 
+	if err := binary.Write(buffer, binary.LittleEndian, e.normalization); err != nil {
+		return nil, fmt.Errorf("erro ao serializar normalização: %v", err)
+	}
+
 	if err := binary.Write(buffer, binary.LittleEndian, e.data); err != nil {
 		return nil, fmt.Errorf("erro ao serializar data: %v", err)
 	}
@@ -44,22 +82,110 @@ func (e *Embedding) Deserialize(data []byte) error {
 		return fmt.Errorf("erro ao desserializar ID: %v", err)
 	}
 
+	if err := binary.Read(buffer, binary.LittleEndian, &e.normalization); err != nil {
+		return fmt.Errorf("erro ao desserializar normalização: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.LittleEndian, &e.data); err != nil {
+		return fmt.Errorf("erro ao desserializar data: %v", err)
+	}
+
+	return nil
+}
+
+// serializeFor encodes the embedding as the given block version expects.
+// Blocks older than BLOCK_VERSION_NORMALIZATION have no normalization byte.
+func (e *Embedding) serializeFor(version uint8) ([]byte, error) {
+	if version >= BLOCK_VERSION_NORMALIZATION {
+		return e.Serialize()
+	}
+
+	buffer := new(bytes.Buffer)
+
+	if err := binary.Write(buffer, binary.LittleEndian, e.id); err != nil {
+		return nil, fmt.Errorf("erro ao serializar ID: %v", err)
+	}
+
+	if err := binary.Write(buffer, binary.LittleEndian, e.data); err != nil {
+		return nil, fmt.Errorf("erro ao serializar data: %v", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (e *Embedding) deserializeFor(data []byte, version uint8) error {
+	if version >= BLOCK_VERSION_NORMALIZATION {
+		return e.Deserialize(data)
+	}
+
+	buffer := bytes.NewReader(data)
+
+	if err := binary.Read(buffer, binary.LittleEndian, &e.id); err != nil {
+		return fmt.Errorf("erro ao desserializar ID: %v", err)
+	}
+
 	if err := binary.Read(buffer, binary.LittleEndian, &e.data); err != nil {
 		return fmt.Errorf("erro ao desserializar data: %v", err)
 	}
 
+	e.normalization = NORMALIZATION_NONE
+
+	return nil
+}
+
+func embeddingSizeFor(version uint8) int {
+	if version < BLOCK_VERSION_NORMALIZATION {
+		return EMBEDDING_LEGACY_SIZE
+	}
+	return EMBEDDING_SIZE
+}
+
+// validateEmbedding rejects vectors that cannot come from the face model
+func validateEmbedding(data [EMBEDDING_DIMENSIONS]float64) error {
+	for i, v := range data {
+		if math.IsNaN(v) {
+			return fmt.Errorf("componente %d do embedding é NaN", i)
+		}
+		if math.IsInf(v, 0) {
+			return fmt.Errorf("componente %d do embedding é infinito", i)
+		}
+	}
+
+	if l2Norm(data) == 0 {
+		return fmt.Errorf("embedding nulo")
+	}
+
 	return nil
 }
 
-func newEmbedding(data [128]float64) (*Embedding, error) {
-	for i := 0; i < len(data); i++ {
-		if data[i] == 0 {
-			value, _ := rand.Int(rand.Reader, big.NewInt(100))
-			data[i] = float64(value.Int64())
+func l2Norm(data [EMBEDDING_DIMENSIONS]float64) float64 {
+	sum := 0.0
+	for _, v := range data {
+		sum += v * v
+	}
+	return math.Sqrt(sum)
+}
+
+// newEmbedding validates the vector and optionally scales it to unit length.
+// The components are never changed other than by the recorded normalization.
+func newEmbedding(data [EMBEDDING_DIMENSIONS]float64, normalize bool) (*Embedding, error) {
+	if err := validateEmbedding(data); err != nil {
+		return nil, err
+	}
+
+	e := &Embedding{data: data, normalization: NORMALIZATION_NONE}
+
+	if normalize {
+		norm := l2Norm(data)
+		if math.IsInf(norm, 0) {
+			return nil, fmt.Errorf("norma do embedding excede o limite de float64")
+		}
+		for i := range e.data {
+			e.data[i] /= norm
 		}
+		e.normalization = NORMALIZATION_L2
 	}
 
-	e := &Embedding{data: data}
 	e.generateId()
 
 	return e, nil
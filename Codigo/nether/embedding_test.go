@@ -0,0 +1,109 @@
+package nether
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewEmbedding(t *testing.T) {
+	withComponent := func(i int, v float64) [EMBEDDING_DIMENSIONS]float64 {
+		data := testVector(1)
+		data[i] = v
+		return data
+	}
+	huge := testVector(2)
+	for i := range huge {
+		huge[i] *= 1e300
+	}
+
+	tests := []struct {
+		name      string
+		data      [EMBEDDING_DIMENSIONS]float64
+		normalize bool
+		ok        bool
+	}{
+		{"model output", testVector(1), false, true},
+		{"model output normalized", testVector(1), true, true},
+		{"NaN", withComponent(5, math.NaN()), false, false},
+		{"NaN normalized", withComponent(5, math.NaN()), true, false},
+		{"+Inf", withComponent(0, math.Inf(1)), false, false},
+		{"-Inf", withComponent(127, math.Inf(-1)), true, false},
+		{"zero vector", [EMBEDDING_DIMENSIONS]float64{}, false, false},
+		{"zero vector normalized", [EMBEDDING_DIMENSIONS]float64{}, true, false},
+		{"norm overflows normalized", huge, true, false},
+		{"norm overflows kept as is", huge, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newEmbedding(tt.data, tt.normalize)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("newEmbedding accepted the vector")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.normalize {
+				if e.normalization != NORMALIZATION_NONE {
+					t.Errorf("normalization = %d, want NORMALIZATION_NONE", e.normalization)
+				}
+				if e.data != tt.data {
+					t.Errorf("components were changed without normalization")
+				}
+				return
+			}
+
+			if e.normalization != NORMALIZATION_L2 {
+				t.Errorf("normalization = %d, want NORMALIZATION_L2", e.normalization)
+			}
+			if norm := l2Norm(e.data); math.Abs(norm-1) > 1e-12 {
+				t.Errorf("norm after L2 normalization = %v, want 1", norm)
+			}
+		})
+	}
+}
+
+func TestValidateEmbeddingNeverChangesComponents(t *testing.T) {
+	data := testVector(3)
+	data[7] = -0.0
+	original := data
+
+	if err := validateEmbedding(data); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEmbedding(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range e.data {
+		if math.Float64bits(e.data[i]) != math.Float64bits(original[i]) {
+			t.Fatalf("component %d changed from %v to %v", i, original[i], e.data[i])
+		}
+	}
+}
+
+func TestEmbeddingNormalizationIsSerialized(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		e, err := newEmbedding(testVector(4), normalize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Embedding
+		if err := decoded.Deserialize(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.normalization != e.normalization || decoded.data != e.data || decoded.id != e.id {
+			t.Errorf("normalize=%v: embedding changed after serialization", normalize)
+		}
+	}
+}
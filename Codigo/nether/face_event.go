@@ -0,0 +1,151 @@
+package nether
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	FACE_EVENT_MAX_STRING = 255
+)
+
+// Direction of a face crossing the camera of an establishment
+type Direction uint8
+
+const (
+	DIRECTION_UNKNOWN Direction = 0
+	DIRECTION_ENTRY   Direction = 1
+	DIRECTION_EXIT    Direction = 2
+)
+
+// FaceEvent describes when and where a face was captured and links it to
+// its embedding and image in the same block
+type FaceEvent struct {
+	CameraID    string
+	SiteID      string
+	Direction   Direction
+	Confidence  float64
+	TrackID     string
+	CapturedAt  uint64 // unix milliseconds
+	EmbeddingID Hash
+	ImageHash   Hash
+}
+
+// ParseDirection accepts "entry", "exit" or an empty/"unknown" direction
+func ParseDirection(s string) (Direction, error) {
+	switch s {
+	case "", "unknown":
+		return DIRECTION_UNKNOWN, nil
+	case "entry":
+		return DIRECTION_ENTRY, nil
+	case "exit":
+		return DIRECTION_EXIT, nil
+	}
+	return DIRECTION_UNKNOWN, fmt.Errorf("direção inválida: %q", s)
+}
+
+// Validate checks the fields that the camera application controls
+func (f *FaceEvent) Validate() error {
+	for name, value := range map[string]string{"camera_id": f.CameraID, "site_id": f.SiteID, "track_id": f.TrackID} {
+		if len(value) > FACE_EVENT_MAX_STRING {
+			return fmt.Errorf("%s excede %d caracteres", name, FACE_EVENT_MAX_STRING)
+		}
+	}
+
+	if f.Direction > DIRECTION_EXIT {
+		return fmt.Errorf("direção inválida: %d", f.Direction)
+	}
+
+	if math.IsNaN(f.Confidence) || f.Confidence < 0 || f.Confidence > 1 {
+		return fmt.Errorf("confiança deve estar entre 0 e 1, recebido %v", f.Confidence)
+	}
+
+	return nil
+}
+
+func writeString(buffer *bytes.Buffer, s string) {
+	buffer.WriteByte(byte(len(s)))
+	buffer.WriteString(s)
+}
+
+func readString(buffer *bytes.Reader) (string, error) {
+	length, err := buffer.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(buffer, data); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (f *FaceEvent) Serialize() ([]byte, error) {
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("erro ao serializar evento: %v", err)
+	}
+
+	buffer := new(bytes.Buffer)
+
+	writeString(buffer, f.CameraID)
+	writeString(buffer, f.SiteID)
+	buffer.WriteByte(byte(f.Direction))
+	binary.Write(buffer, binary.LittleEndian, f.Confidence)
+	writeString(buffer, f.TrackID)
+	binary.Write(buffer, binary.LittleEndian, f.CapturedAt)
+	buffer.Write(f.EmbeddingID[:])
+	buffer.Write(f.ImageHash[:])
+
+	return buffer.Bytes(), nil
+}
+
+// deserializeFrom reads one event from buffer, leaving it at the next event
+func (f *FaceEvent) deserializeFrom(buffer *bytes.Reader) error {
+	var err error
+
+	if f.CameraID, err = readString(buffer); err != nil {
+		return fmt.Errorf("erro ao desserializar camera: %v", err)
+	}
+
+	if f.SiteID, err = readString(buffer); err != nil {
+		return fmt.Errorf("erro ao desserializar local: %v", err)
+	}
+
+	direction, err := buffer.ReadByte()
+	if err != nil {
+		return fmt.Errorf("erro ao desserializar direção: %v", err)
+	}
+	f.Direction = Direction(direction)
+
+	if err := binary.Read(buffer, binary.LittleEndian, &f.Confidence); err != nil {
+		return fmt.Errorf("erro ao desserializar confiança: %v", err)
+	}
+
+	if f.TrackID, err = readString(buffer); err != nil {
+		return fmt.Errorf("erro ao desserializar track: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.LittleEndian, &f.CapturedAt); err != nil {
+		return fmt.Errorf("erro ao desserializar horário: %v", err)
+	}
+
+	if _, err := io.ReadFull(buffer, f.EmbeddingID[:]); err != nil {
+		return fmt.Errorf("erro ao desserializar embedding: %v", err)
+	}
+
+	if _, err := io.ReadFull(buffer, f.ImageHash[:]); err != nil {
+		return fmt.Errorf("erro ao desserializar imagem: %v", err)
+	}
+
+	return f.Validate()
+}
+
+// computeSize returns the serialized size of the event in bytes
+func (f *FaceEvent) computeSize() int {
+	return 1 + len(f.CameraID) + 1 + len(f.SiteID) + 1 + 8 + 1 + len(f.TrackID) + 8 + CIPHER_SIZE + CIPHER_SIZE
+}
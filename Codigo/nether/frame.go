@@ -0,0 +1,58 @@
+package nether
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Peers exchange length prefixed frames, read with io.ReadFull so that short
+// reads and coalesced segments never split or merge messages:
+//
+//	frame: type uint8 | length uint32 | payload
+const (
+	FRAME_HEADER_SIZE int    = 1 + 4
+	MAX_FRAME_SIZE    uint32 = 16 << 20 // chains travel in batches of blocks, see BLOCKS_BATCH_BYTES
+
+	FRAME_MESSAGE   uint8 = 0x01 // text command, as handled by dealWithRequisition
+	FRAME_HANDSHAKE uint8 = 0x02 // authentication, before the transport is encrypted
+	FRAME_REQUEST   uint8 = 0x03 // text command waiting for a response, see request
+	FRAME_RESPONSE  uint8 = 0x04 // response to the request with the same ID
+)
+
+// writeFrame sends the frame in a single Write; on a peer connection that
+// Write queues the whole frame for its writer, see peerConn
+func writeFrame(w io.Writer, frameType uint8, payload []byte) error {
+	if uint64(len(payload)) > uint64(MAX_FRAME_SIZE) {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(payload), MAX_FRAME_SIZE)
+	}
+
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	frame[0] = frameType
+	binary.LittleEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads the next frame whose payload is at most maxSize bytes. A
+// frame over the limit is not read, the connection must be dropped.
+func readFrame(r io.Reader, maxSize uint32) (uint8, []byte, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[1:])
+	if size > maxSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", size, maxSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("truncated frame: %w", err)
+	}
+
+	return header[0], payload, nil
+}
@@ -0,0 +1,48 @@
+package nether
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func FuzzReadFrame(f *testing.F) {
+	var valid bytes.Buffer
+	writeFrame(&valid, FRAME_MESSAGE, []byte("PING"))
+	f.Add(valid.Bytes())
+	f.Add(valid.Bytes()[:FRAME_HEADER_SIZE+1])
+	f.Add([]byte{FRAME_REQUEST})
+
+	oversized := make([]byte, FRAME_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(oversized[1:], MAX_FRAME_SIZE+1)
+	f.Add(oversized)
+
+	const maxSize = 1 << 10
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frameType, payload, err := readFrame(bytes.NewReader(data), maxSize)
+		if err != nil {
+			return
+		}
+		if len(payload) > maxSize {
+			t.Fatalf("read a payload of %d bytes over the limit of %d", len(payload), maxSize)
+		}
+
+		var encoded bytes.Buffer
+		if err := writeFrame(&encoded, frameType, payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, encoded.Bytes()) {
+			t.Fatal("the frame read does not encode back to the input")
+		}
+	})
+}
+
+func TestWriteFrameRejectsOversizedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, FRAME_MESSAGE, make([]byte, MAX_FRAME_SIZE+1)); err == nil {
+		t.Fatal("wrote a frame over MAX_FRAME_SIZE")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("wrote %d bytes of a rejected frame", buf.Len())
+	}
+}
@@ -0,0 +1,92 @@
+package nether
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Handlers are shared by the tests and may still run after a test ends
+var init_handlers_once sync.Once
+
+// useTempDir runs the test inside an empty directory with a data folder, as
+// the chain, keystore and image database paths are relative to it
+func useTempDir(t *testing.T) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Mkdir("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useTestNode logs in with a new key and creates the local chain
+func useTestNode(t *testing.T) {
+	t.Helper()
+	useTempDir(t)
+
+	userdata = &UserData{Name: "test", Key: *NewKey()}
+	r, err := newBlockchain(userdata.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = r
+
+	t.Cleanup(func() {
+		if reader != nil {
+			reader.Close()
+		}
+		reader, userdata = nil, nil
+	})
+}
+
+// useLeaderPipe connects the node to itself through a pipe, the returned end
+// registered as the connection to a leader and both ends read by startChat
+func useLeaderPipe(t *testing.T) net.Conn {
+	t.Helper()
+	init_handlers_once.Do(initHandlers)
+
+	a, b := net.Pipe()
+	local, remote := newPeerConn(a), newPeerConn(b)
+	peer_manager.Add("test-leader", local, ROLE_LEADER, PEER_OUTBOUND)
+	go startChat(local)
+	go startChat(remote)
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+		peer_manager.Remove(local)
+	})
+	return local
+}
+
+// testVector looks like the output of the face model: 128 gaussian components
+func testVector(seed int64) [EMBEDDING_DIMENSIONS]float64 {
+	rng := rand.New(rand.NewSource(seed))
+
+	var data [EMBEDDING_DIMENSIONS]float64
+	for i := range data {
+		data[i] = rng.NormFloat64() * 0.1
+	}
+	return data
+}
+
+func testEmbedding(t *testing.T, seed int64) *Embedding {
+	t.Helper()
+
+	e, err := newEmbedding(testVector(seed), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
@@ -5,16 +5,57 @@ import (
 	"fmt"
 )
 
+const (
+	IMAGE_SIZE      = CIPHER_SIZE
+	IMAGE_PATH_SIZE = 200
+)
+
+// Image references a face chip by the SHA-256 of its bytes in the image
+// database. Blocks older than BLOCK_VERSION_IMAGE_HASH only carry a path.
 type Image struct {
-	data string
+	hash Hash
+	path string
+}
+
+// newImage saves data in the image database and returns its reference
+func newImage(data []byte) (*Image, error) {
+	hash, err := storeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{hash: hash}, nil
+}
+
+// Load reads the image bytes from the database, checking them against the hash
+func (img *Image) Load() ([]byte, error) {
+	if img.path != "" {
+		return nil, fmt.Errorf("imagem legada referencia apenas o caminho %s", img.path)
+	}
+
+	return loadImage(img.hash)
 }
 
 func (img *Image) Serialize() ([]byte, error) {
-	if len(img.data) > 200 {
-		return nil, fmt.Errorf("string excede o tamanho máximo permitido de 200 caracteres")
+	return append([]byte{}, img.hash[:]...), nil
+}
+
+func (img *Image) Deserialize(data []byte) error {
+	if len(data) != IMAGE_SIZE {
+		return fmt.Errorf("tamanho dos dados inválido: esperado %d bytes, recebido %d bytes", IMAGE_SIZE, len(data))
 	}
 
-	paddedData := fmt.Sprintf("%-200s", img.data)
+	copy(img.hash[:], data)
+
+	return nil
+}
+
+func (img *Image) serializePath() ([]byte, error) {
+	if len(img.path) > IMAGE_PATH_SIZE {
+		return nil, fmt.Errorf("string excede o tamanho máximo permitido de %d caracteres", IMAGE_PATH_SIZE)
+	}
+
+	paddedData := fmt.Sprintf("%-*s", IMAGE_PATH_SIZE, img.path)
 	dataBytes := []byte(paddedData)
 
 	buffer := new(bytes.Buffer)
@@ -26,12 +67,34 @@ func (img *Image) Serialize() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-func (img *Image) Deserialize(data []byte) error {
-	if len(data) != 200 {
-		return fmt.Errorf("tamanho dos dados inválido: esperado 200 bytes, recebido %d bytes", len(data))
+func (img *Image) deserializePath(data []byte) error {
+	if len(data) != IMAGE_PATH_SIZE {
+		return fmt.Errorf("tamanho dos dados inválido: esperado %d bytes, recebido %d bytes", IMAGE_PATH_SIZE, len(data))
 	}
 
-	img.data = string(bytes.TrimRight(data, " "))
+	img.path = string(bytes.TrimRight(data, " "))
 
 	return nil
 }
+
+// serializeFor encodes the image as the given block version expects
+func (img *Image) serializeFor(version uint8) ([]byte, error) {
+	if version < BLOCK_VERSION_IMAGE_HASH {
+		return img.serializePath()
+	}
+	return img.Serialize()
+}
+
+func (img *Image) deserializeFor(data []byte, version uint8) error {
+	if version < BLOCK_VERSION_IMAGE_HASH {
+		return img.deserializePath(data)
+	}
+	return img.Deserialize(data)
+}
+
+func imageSizeFor(version uint8) int {
+	if version < BLOCK_VERSION_IMAGE_HASH {
+		return IMAGE_PATH_SIZE
+	}
+	return IMAGE_SIZE
+}
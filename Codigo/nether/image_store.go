@@ -0,0 +1,122 @@
+package nether
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// imagePath returns the blob path of an image, sharded by the first hash byte
+func imagePath(hash Hash) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(IMAGES_PATH, name[:2], name)
+}
+
+// storeImage writes data to the image database under its SHA-256. Images are
+// stored before the block that references them, so a block that fails to be
+// written leaves its images behind. They are kept, as the same bytes may be
+// referenced by another block, and verifyImages ignores them.
+func storeImage(data []byte) (Hash, error) {
+	hash := sha256.Sum256(data)
+	path := imagePath(hash)
+
+	if hasImage(hash) {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return hash, fmt.Errorf("cannot create image database: %w", err)
+	}
+
+	// Concurrent stores of the same image each write their own temporary file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return hash, fmt.Errorf("cannot write image: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return hash, fmt.Errorf("cannot write image: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		if hasImage(hash) {
+			return hash, nil
+		}
+		return hash, fmt.Errorf("cannot write image: %w", err)
+	}
+
+	return hash, nil
+}
+
+// loadImage reads an image from the database and rejects it if the bytes no
+// longer match the hash committed in the chain
+func loadImage(hash Hash) ([]byte, error) {
+	data, err := os.ReadFile(imagePath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image %x: %w", hash, err)
+	}
+
+	if sha256.Sum256(data) != hash {
+		return nil, fmt.Errorf("image %x was modified on disk", hash)
+	}
+
+	return data, nil
+}
+
+// storeImageIfMatches saves data received from a peer only if it hashes to
+// the hex encoded hash that was requested
+func storeImageIfMatches(expected string, data []byte) (Hash, error) {
+	hash := sha256.Sum256(data)
+	if want, err := DecodeHash(expected); err != nil || want != hash {
+		return hash, fmt.Errorf("content hash %x does not match %s", hash, expected)
+	}
+
+	return storeImage(data)
+}
+
+func hasImage(hash Hash) bool {
+	_, err := os.Stat(imagePath(hash))
+	return err == nil
+}
+
+// verifyImages checks every image of the chain present in the database and
+// returns the hashes of the missing ones. Images no block references are not
+// checked.
+func verifyImages(s ChainStore) ([]Hash, error) {
+	missing := make([]Hash, 0)
+	var imageErr error
+
+	err := s.Scan(0, func(b *Block) bool {
+		if b.Version < BLOCK_VERSION_IMAGE_HASH {
+			return true
+		}
+
+		for i := range b.Storage.Images {
+			hash := b.Storage.Images[i].hash
+			if !hasImage(hash) {
+				missing = append(missing, hash)
+				continue
+			}
+			if _, err := loadImage(hash); err != nil {
+				imageErr = fmt.Errorf("block %d: %w", b.Index, err)
+				return false
+			}
+		}
+		return true
+	})
+
+	if imageErr != nil {
+		return missing, imageErr
+	}
+	return missing, err
+}
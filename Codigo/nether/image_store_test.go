@@ -0,0 +1,70 @@
+package nether
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStoreImageConcurrently(t *testing.T) {
+	useTempDir(t)
+
+	data := []byte("face")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := storeImage(data); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	hash, err := storeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := loadImage(hash); err != nil || string(stored) != "face" {
+		t.Fatalf("loadImage = %q, %v", stored, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(imagePath(hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("image directory has %d files, want only the image", len(entries))
+	}
+}
+
+// Images of a block that was never written stay in the database unreferenced
+func TestVerifyImagesIgnoresOrphans(t *testing.T) {
+	useTestNode(t)
+
+	img, err := newImage([]byte("face"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEmbedding(t, 1)
+	_, err = reader.Append(func(last *Block) (*Block, error) {
+		return NewBlock(last, userdata.Key, *NewStorage([]Embedding{*e}, []Image{*img}, nil))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storeImage([]byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := verifyImages(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("%d images reported missing, want none", len(missing))
+	}
+}
@@ -0,0 +1,257 @@
+package nether
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Block index sidecar: a header tying it to the chain followed by one fixed
+// size record (offset, hash) per height
+const (
+	INDEX_SUFFIX      string = ".index"
+	INDEX_MAGIC       string = "NTIX"
+	INDEX_HEADER_SIZE int64  = int64(len(INDEX_MAGIC) + CIPHER_SIZE)
+	INDEX_RECORD_SIZE int64  = int64(8 + CIPHER_SIZE)
+)
+
+type blockIndex struct {
+	file   *os.File
+	count  uint64
+	byHash map[Hash]uint64
+}
+
+func (ix *blockIndex) Close() error {
+	return ix.file.Close()
+}
+
+// record returns the offset and hash stored for height
+func (ix *blockIndex) record(height uint64) (uint64, Hash, error) {
+	var hash Hash
+	if height >= ix.count {
+		return 0, hash, fmt.Errorf("block %d not found", height)
+	}
+
+	raw := make([]byte, INDEX_RECORD_SIZE)
+	if _, err := ix.file.ReadAt(raw, INDEX_HEADER_SIZE+int64(height)*INDEX_RECORD_SIZE); err != nil {
+		return 0, hash, fmt.Errorf("cannot read index record %d: %w", height, err)
+	}
+	copy(hash[:], raw[8:])
+
+	return binary.LittleEndian.Uint64(raw[:8]), hash, nil
+}
+
+func (ix *blockIndex) append(offset uint64, hash Hash) error {
+	raw := make([]byte, INDEX_RECORD_SIZE)
+	binary.LittleEndian.PutUint64(raw[:8], offset)
+	copy(raw[8:], hash[:])
+
+	if _, err := ix.file.WriteAt(raw, INDEX_HEADER_SIZE+int64(ix.count)*INDEX_RECORD_SIZE); err != nil {
+		return fmt.Errorf("cannot write index record %d: %w", ix.count, err)
+	}
+
+	ix.byHash[hash] = ix.count
+	ix.count++
+	return nil
+}
+
+// reset truncates the index and writes a header for the chain starting at firstBlockHash
+func (ix *blockIndex) reset(firstBlockHash Hash) error {
+	if err := ix.file.Truncate(0); err != nil {
+		return fmt.Errorf("cannot truncate index: %w", err)
+	}
+
+	var header bytes.Buffer
+	header.WriteString(INDEX_MAGIC)
+	header.Write(firstBlockHash[:])
+	if _, err := ix.file.WriteAt(header.Bytes(), 0); err != nil {
+		return fmt.Errorf("cannot write index header: %w", err)
+	}
+
+	ix.count = 0
+	ix.byHash = make(map[Hash]uint64)
+	return nil
+}
+
+// load reads the index file, returning false if it does not belong to a
+// chain starting at firstBlockHash
+func (ix *blockIndex) load(firstBlockHash Hash) bool {
+	info, err := ix.file.Stat()
+	if err != nil || info.Size() < INDEX_HEADER_SIZE || (info.Size()-INDEX_HEADER_SIZE)%INDEX_RECORD_SIZE != 0 {
+		return false
+	}
+
+	data := make([]byte, info.Size())
+	if _, err := io.ReadFull(io.NewSectionReader(ix.file, 0, info.Size()), data); err != nil {
+		return false
+	}
+
+	if string(data[:len(INDEX_MAGIC)]) != INDEX_MAGIC || !bytes.Equal(data[len(INDEX_MAGIC):INDEX_HEADER_SIZE], firstBlockHash[:]) {
+		return false
+	}
+
+	ix.count = uint64((info.Size() - INDEX_HEADER_SIZE) / INDEX_RECORD_SIZE)
+	ix.byHash = make(map[Hash]uint64, ix.count)
+	for height := uint64(0); height < ix.count; height++ {
+		var hash Hash
+		start := INDEX_HEADER_SIZE + int64(height)*INDEX_RECORD_SIZE + 8
+		copy(hash[:], data[start:start+CIPHER_SIZE])
+		ix.byHash[hash] = height
+	}
+
+	return true
+}
+
+// indexInSync checks the index against the chain metadata and its last block.
+// The caller must hold mu.
+func (r *NetherReader) indexInSync() bool {
+	stored := r.size - r.base
+	if r.index.count != stored {
+		return false
+	}
+
+	if stored == 0 {
+		return true
+	}
+
+	offset, hash, err := r.index.record(stored - 1)
+	if err != nil || offset != r.lastBlockOffset {
+		return false
+	}
+
+	last, _, err := r.readBlockAt(int64(r.lastBlockOffset))
+	return err == nil && last.Hash == hash
+}
+
+// openIndex loads the index sidecar of the chain, rebuilding it when missing or
+// stale. The caller must hold mu.
+func (r *NetherReader) openIndex() error {
+	if r.index != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(r.path+INDEX_SUFFIX, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open index: %w", err)
+	}
+
+	r.index = &blockIndex{file: file, byHash: make(map[Hash]uint64)}
+	if r.index.load(r.firstBlockHash) && r.indexInSync() {
+		return nil
+	}
+
+	return r.rebuildIndex()
+}
+
+// RebuildIndex scans the whole chain and rewrites the index sidecar
+func (r *NetherReader) RebuildIndex() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.index == nil {
+		return r.openIndex()
+	}
+	return r.rebuildIndex()
+}
+
+// rebuildIndex rewrites the open index from the chain. The caller must hold mu.
+func (r *NetherReader) rebuildIndex() error {
+	if err := r.index.reset(r.firstBlockHash); err != nil {
+		return err
+	}
+
+	if r.size == 0 {
+		return nil
+	}
+
+	offset := METADATA_SIZE
+	for {
+		b, next, err := r.readBlockAt(offset)
+		if err != nil {
+			return err
+		}
+
+		if err := r.index.append(uint64(offset), b.Hash); err != nil {
+			return err
+		}
+
+		if b.Index >= r.lastBlockIndex {
+			break
+		}
+		offset = next
+	}
+
+	return r.index.file.Sync()
+}
+
+// baseIndex returns the height of the first block stored in the file, which
+// is not the genesis for chains bootstrapped from a checkpoint. The caller
+// must hold mu.
+func (r *NetherReader) baseIndex() uint64 {
+	return r.base
+}
+
+// readLockIndex returns with mu read locked and the index open, so lookups
+// run in parallel once the index is loaded. Opening it takes the write lock.
+// The caller must release mu with RUnlock unless an error is returned.
+func (r *NetherReader) readLockIndex() error {
+	for {
+		r.mu.RLock()
+		if r.index != nil {
+			return nil
+		}
+		r.mu.RUnlock()
+
+		// A failed append may close the index again before it is read locked
+		r.mu.Lock()
+		err := r.openIndex()
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// blockOffset looks up the offset of the block at height in the index
+func (r *NetherReader) blockOffset(height uint64) (uint64, error) {
+	if err := r.readLockIndex(); err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+
+	if height < r.baseIndex() {
+		return 0, fmt.Errorf("block %d is older than the local history, which starts at %d", height, r.baseIndex())
+	}
+
+	offset, _, err := r.index.record(height - r.baseIndex())
+	return offset, err
+}
+
+// ReadBlockAt reads the block at the given height using the index
+func (r *NetherReader) ReadBlockAt(index uint64) (*Block, error) {
+	offset, err := r.blockOffset(index)
+	if err != nil {
+		return nil, err
+	}
+
+	b, _, err := r.readBlockAt(int64(offset))
+	return b, err
+}
+
+// ReadBlockByHash reads the block with the given hash using the index
+func (r *NetherReader) ReadBlockByHash(hash Hash) (*Block, error) {
+	if err := r.readLockIndex(); err != nil {
+		return nil, err
+	}
+	height, exists := r.index.byHash[hash]
+	height += r.baseIndex()
+	r.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+
+	return r.ReadBlockAt(height)
+}
@@ -0,0 +1,90 @@
+package nether
+
+// Iterator walks the committed blocks of the chain from the genesis. It keeps
+// its own offset, so several iterators and a writer can use the same reader.
+type Iterator struct {
+	r           *NetherReader
+	offset      int64
+	blockOffset int64
+	block       *Block
+	err         error
+}
+
+func (r *NetherReader) Iterator() *Iterator {
+	return &Iterator{r: r, offset: METADATA_SIZE}
+}
+
+// IteratorFrom returns an iterator whose first block is the one at height,
+// found through the block index
+func (r *NetherReader) IteratorFrom(height uint64) (*Iterator, error) {
+	offset, err := r.blockOffset(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Iterator{r: r, offset: int64(offset)}, nil
+}
+
+// Scan walks the chain from height on, sequentially instead of looking up every height
+func (r *NetherReader) Scan(from uint64, yield func(b *Block) bool) error {
+	if from > r.Metadata().LastBlockIndex {
+		return nil
+	}
+
+	it := r.Iterator()
+	if from > 0 {
+		var err error
+		if it, err = r.IteratorFrom(from); err != nil {
+			return err
+		}
+	}
+
+	for it.Next() {
+		if !yield(it.Block()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// Next reads the following block, returning false at the end of the chain or on error
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.r.mu.RLock()
+	size := it.r.size
+	lastBlockIndex := it.r.lastBlockIndex
+	it.r.mu.RUnlock()
+
+	if size == 0 || (it.block != nil && it.block.Index >= lastBlockIndex) {
+		return false
+	}
+
+	b, next, err := it.r.readBlockAt(it.offset)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.block = b
+	it.blockOffset = it.offset
+	it.offset = next
+	return true
+}
+
+// Block returns the block read by the last call to Next
+func (it *Iterator) Block() *Block {
+	return it.block
+}
+
+// Offset returns the file offset of the block read by the last call to Next
+func (it *Iterator) Offset() int64 {
+	return it.blockOffset
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,64 @@
+package nether
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The keystore key is derived from the password with scrypt (RFC 7914), which
+// needs 128 * KDF_R * 2^KDF_LOG_N bytes of memory per guess
+const (
+	KDF_SALT_SIZE int    = 16
+	KDF_LOG_N     uint8  = 15
+	KDF_R         uint32 = 8
+	KDF_P         uint32 = 1
+
+	KDF_MAX_LOG_N  uint8  = 22
+	KDF_MAX_MEMORY uint64 = 1 << 30
+)
+
+// kdfParams are stored in the keystore header so they can be raised later
+// without breaking existing files
+type kdfParams struct {
+	LogN uint8
+	R    uint32
+	P    uint32
+	Salt [KDF_SALT_SIZE]byte
+}
+
+func newKdfParams() kdfParams {
+	p := kdfParams{LogN: KDF_LOG_N, R: KDF_R, P: KDF_P}
+	if _, err := io.ReadFull(rand.Reader, p.Salt[:]); err != nil {
+		panic(fmt.Sprintf("falha ao gerar salt: %v", err))
+	}
+	return p
+}
+
+// validate rejects parameters that would exhaust the memory of the node
+func (p kdfParams) validate() error {
+	if p.LogN < 1 || p.LogN > KDF_MAX_LOG_N {
+		return fmt.Errorf("invalid scrypt cost 2^%d", p.LogN)
+	}
+	if p.R == 0 || p.P == 0 || uint64(p.R)*uint64(p.P) >= 1<<30 {
+		return fmt.Errorf("invalid scrypt parameters r=%d p=%d", p.R, p.P)
+	}
+	if memory := uint64(128) * uint64(p.R) << p.LogN; memory > KDF_MAX_MEMORY {
+		return fmt.Errorf("scrypt parameters need %d bytes of memory", memory)
+	}
+	return nil
+}
+
+// deriveKey returns the AES-256 key for password. The parameters must be valid.
+func (p kdfParams) deriveKey(password string) Hash {
+	key, err := scrypt.Key([]byte(password), p.Salt[:], 1<<p.LogN, int(p.R), int(p.P), CIPHER_SIZE)
+	if err != nil {
+		panic(fmt.Sprintf("parâmetros do scrypt inválidos: %v", err))
+	}
+
+	var hash Hash
+	copy(hash[:], key)
+	return hash
+}
@@ -0,0 +1,115 @@
+package nether
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors of RFC 7914, section 12
+func TestScryptVectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		n, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1, "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			want := mustHex(t, tt.want)
+			got, err := scrypt.Key([]byte(tt.password), []byte(tt.salt), tt.n, tt.r, tt.p, len(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Fatalf("scrypt = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test vectors of RFC 7914, section 11
+func TestPBKDF2SHA256Vectors(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			want := mustHex(t, tt.want)
+			got := pbkdf2.Key([]byte(tt.password), []byte(tt.salt), tt.iterations, len(want), sha256.New)
+			if hex.EncodeToString(got) != tt.want {
+				t.Fatalf("pbkdf2 = %x, want %s", got, tt.want)
+			}
+
+			// Shorter keys are a prefix of the longer ones
+			if short := pbkdf2.Key([]byte(tt.password), []byte(tt.salt), tt.iterations, 20, sha256.New); hex.EncodeToString(short) != tt.want[:40] {
+				t.Fatalf("pbkdf2 of 20 bytes = %x, want %s", short, tt.want[:40])
+			}
+		})
+	}
+}
+
+func TestDeriveKeyUsesParams(t *testing.T) {
+	p := kdfParams{LogN: 4, R: 2, P: 1}
+	copy(p.Salt[:], "0123456789abcdef")
+
+	want, err := scrypt.Key([]byte("password"), p.Salt[:], 16, 2, 1, CIPHER_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.deriveKey("password"); hex.EncodeToString(got[:]) != hex.EncodeToString(want) {
+		t.Fatalf("deriveKey = %x, want %x", got, want)
+	}
+
+	other := p
+	other.Salt[0] ^= 1
+	if other.deriveKey("password") == p.deriveKey("password") {
+		t.Fatal("different salts derived the same key")
+	}
+}
+
+func TestKdfParamsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     kdfParams
+		valid bool
+	}{
+		{"default", kdfParams{LogN: KDF_LOG_N, R: KDF_R, P: KDF_P}, true},
+		{"zero cost", kdfParams{LogN: 0, R: KDF_R, P: KDF_P}, false},
+		{"cost over the limit", kdfParams{LogN: KDF_MAX_LOG_N + 1, R: 1, P: 1}, false},
+		{"zero r", kdfParams{LogN: KDF_LOG_N, R: 0, P: KDF_P}, false},
+		{"zero p", kdfParams{LogN: KDF_LOG_N, R: KDF_R, P: 0}, false},
+		{"too much memory", kdfParams{LogN: KDF_MAX_LOG_N, R: KDF_R, P: KDF_P}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.validate(); (err == nil) != tt.valid {
+				t.Fatalf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
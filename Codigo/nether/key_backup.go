@@ -0,0 +1,217 @@
+package nether
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key backups are PKCS#8 EncryptedPrivateKeyInfo PEM files (RFC 5958) using
+// PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC, readable by openssl. The key
+// is encoded by crypto/x509 and derived by x/crypto/pbkdf2; neither writes the
+// PBES2 envelope, so only its ASN.1 structures are defined here.
+const (
+	KEY_BACKUP_PEM_TYPE   string = "ENCRYPTED PRIVATE KEY"
+	KEY_BACKUP_ITERATIONS int    = 600000
+	KEY_BACKUP_SALT_SIZE  int    = 16
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pkcs8 and ecPrivateKey are parsed by hand on import because x509 recomputes
+// the public key from the scalar and ignores the one stored in the backup
+type pkcs8 struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+func algorithm(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	der, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: der}}, nil
+}
+
+// marshalKeyBackup encrypts k with password as a PKCS#8 PEM block
+func marshalKeyBackup(k Key, password string) ([]byte, error) {
+	plaintext, err := x509.MarshalPKCS8PrivateKey(BytesToEcdsaPrivateKey(k.Sk))
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode private key: %w", err)
+	}
+
+	salt := make([]byte, KEY_BACKUP_SALT_SIZE)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, KEY_BACKUP_ITERATIONS, 32, sha256.New)
+	block, _ := aes.NewCipher(key)
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdf, err := algorithm(oidPBKDF2, pbkdf2Params{
+		Salt:           salt,
+		IterationCount: KEY_BACKUP_ITERATIONS,
+		KeyLength:      len(key),
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := algorithm(oidAES256CBC, iv)
+	if err != nil {
+		return nil, err
+	}
+	pbes2, err := algorithm(oidPBES2, pbes2Params{KeyDerivationFunc: kdf, EncryptionScheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2, EncryptedData: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: KEY_BACKUP_PEM_TYPE, Bytes: der}), nil
+}
+
+// parseKeyBackup decrypts a backup written by marshalKeyBackup and checks
+// that its public key belongs to the private scalar
+func parseKeyBackup(data []byte, password string) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != KEY_BACKUP_PEM_TYPE {
+		return nil, fmt.Errorf("no %s PEM block found", KEY_BACKUP_PEM_TYPE)
+	}
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("invalid key backup: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key backup encryption %v", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid key backup: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("unsupported key backup encryption, expected PBKDF2 with AES-256-CBC")
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid key backup: %w", err)
+	}
+	if len(kdf.PRF.Algorithm) != 0 && !kdf.PRF.Algorithm.Equal(oidHMACSHA256) {
+		return nil, fmt.Errorf("unsupported key backup PRF %v", kdf.PRF.Algorithm)
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > 100*KEY_BACKUP_ITERATIONS {
+		return nil, fmt.Errorf("invalid key backup iteration count %d", kdf.IterationCount)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != 32 {
+		return nil, fmt.Errorf("invalid key backup key length %d, AES-256 needs 32", kdf.KeyLength)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key backup IV")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid key backup ciphertext size")
+	}
+
+	aesBlock, _ := aes.NewCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, 32, sha256.New))
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(aesBlock, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("wrong password or corrupted key backup")
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+
+	parsed, err := x509.ParsePKCS8PrivateKey(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("wrong password or corrupted key backup: %w", err)
+	}
+	priv, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || priv.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key backup does not hold a P-256 ECDSA key")
+	}
+
+	k := &Key{}
+	priv.D.FillBytes(k.Sk[:])
+	x, y := elliptic.P256().ScalarBaseMult(k.Sk[:])
+	x.FillBytes(k.Pk[:32])
+	y.FillBytes(k.Pk[32:])
+
+	// The public key stored in the backup must match the scalar
+	var outer pkcs8
+	var inner ecPrivateKey
+	if _, err := asn1.Unmarshal(plaintext, &outer); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if _, err := asn1.Unmarshal(outer.PrivateKey, &inner); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if len(inner.PublicKey.Bytes) == 0 {
+		return nil, fmt.Errorf("key backup has no public key")
+	}
+	if !bytes.Equal(inner.PublicKey.Bytes, append([]byte{4}, k.Pk[:]...)) {
+		return nil, fmt.Errorf("public key of the backup does not match its private key")
+	}
+
+	return k, nil
+}
@@ -0,0 +1,163 @@
+package nether
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// sealTestBackup encrypts plaintext as marshalKeyBackup does, with few
+// iterations, so a backup can hold an arbitrary private key structure
+func sealTestBackup(t *testing.T, plaintext []byte, password string) []byte {
+	t.Helper()
+
+	salt := make([]byte, KEY_BACKUP_SALT_SIZE)
+	iv := make([]byte, aes.BlockSize)
+	io.ReadFull(rand.Reader, salt)
+	io.ReadFull(rand.Reader, iv)
+
+	key := pbkdf2.Key([]byte(password), salt, 1000, 32, sha256.New)
+	block, _ := aes.NewCipher(key)
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdf, err := algorithm(oidPBKDF2, pbkdf2Params{
+		Salt:           salt,
+		IterationCount: 1000,
+		KeyLength:      len(key),
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme, err := algorithm(oidAES256CBC, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbes2, err := algorithm(oidPBES2, pbes2Params{KeyDerivationFunc: kdf, EncryptionScheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2, EncryptedData: ciphertext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: KEY_BACKUP_PEM_TYPE, Bytes: der})
+}
+
+// withPublicKey returns the PKCS#8 encoding of the private key of k claiming pk as its public key
+func withPublicKey(t *testing.T, k Key, pk PublicKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(BytesToEcdsaPrivateKey(k.Sk))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outer pkcs8
+	var inner ecPrivateKey
+	if _, err := asn1.Unmarshal(der, &outer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(outer.PrivateKey, &inner); err != nil {
+		t.Fatal(err)
+	}
+
+	point := append([]byte{4}, pk[:]...)
+	inner.PublicKey = asn1.BitString{Bytes: point, BitLength: 8 * len(point)}
+	if outer.PrivateKey, err = asn1.Marshal(inner); err != nil {
+		t.Fatal(err)
+	}
+	if der, err = asn1.Marshal(outer); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestKeyBackupRoundTrip(t *testing.T) {
+	k := *NewKey()
+	data, err := marshalKeyBackup(k, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseKeyBackup(data, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Sk != k.Sk || parsed.Pk != k.Pk {
+		t.Fatal("the imported key differs from the exported one")
+	}
+
+	if _, err := parseKeyBackup(data, "wrong password"); err == nil {
+		t.Fatal("imported the backup with a wrong password")
+	}
+}
+
+func TestKeyBackupRejectsMismatchedPublicKey(t *testing.T) {
+	k, other := *NewKey(), *NewKey()
+
+	// The same structure with the right public key is accepted
+	if _, err := parseKeyBackup(sealTestBackup(t, withPublicKey(t, k, k.Pk), "pw"), "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := parseKeyBackup(sealTestBackup(t, withPublicKey(t, k, other.Pk), "pw"), "pw")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("parseKeyBackup() = %v, want a public key mismatch", err)
+	}
+}
+
+func TestKeyBackupRejectsOtherPEM(t *testing.T) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{0x30, 0x00}})
+	if _, err := parseKeyBackup(data, "pw"); err == nil {
+		t.Fatal("parsed an unencrypted PEM block as a backup")
+	}
+}
+
+func TestImportKeyAddsIdentity(t *testing.T) {
+	useTempDir(t)
+
+	existing, err := register("main", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := *NewKey()
+	data, err := marshalKeyBackup(k, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportKey(path, "backup", "main", "other"); err == nil {
+		t.Fatal("imported a key over an existing identity")
+	}
+	if ok, m := LoadConfig("main", "pw"); !ok || m.Key != existing.Key {
+		t.Fatal("the existing identity was changed by a refused import")
+	}
+
+	if err := ImportKey(path, "backup", "imported", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, m := LoadConfig("imported", "other"); !ok || m.Key != k {
+		t.Fatal("the imported identity does not hold the key of the backup")
+	}
+}
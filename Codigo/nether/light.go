@@ -0,0 +1,116 @@
+package nether
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Light nodes keep only the headers of the blocks they receive and fetch the
+// storage from a leader when it is needed
+const (
+	PAYLOAD_TIMEOUT time.Duration = 10 * time.Second
+)
+
+var (
+	light_mode atomic.Bool
+)
+
+// SetLightMode chooses whether blocks received from peers are stored without their storage
+func SetLightMode(enabled bool) {
+	light_mode.Store(enabled)
+}
+
+func LightMode() bool {
+	return light_mode.Load()
+}
+
+// receivedBlock returns b as it should be stored locally
+func receivedBlock(b *Block) *Block {
+	if light_mode.Load() {
+		return b.Header()
+	}
+	return b
+}
+
+// blocksRequest asks for the blocks from height on, only their headers when
+// headers is set, as light nodes do
+func blocksRequest(from uint64, headers bool) string {
+	if headers {
+		return fmt.Sprintf("GET_BLOCKS %d headers", from)
+	}
+	return fmt.Sprintf("GET_BLOCKS %d", from)
+}
+
+// FetchPayload returns b with its storage, asking a leader for it when only
+// the header is stored locally. The storage is checked against the header and
+// is not written to disk.
+func FetchPayload(b *Block) (*Block, error) {
+	if !b.HeaderOnly {
+		return b, nil
+	}
+
+	leaderConn, leaderExists := peer_manager.Any(ROLE_LEADER)
+	if !leaderExists {
+		return nil, fmt.Errorf("no leader available to fetch the storage of block %d", b.Index)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PAYLOAD_TIMEOUT)
+	defer cancel()
+	response, err := request(ctx, leaderConn, fmt.Sprintf("GET_PAYLOAD %x", b.Hash))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Fields(response)
+	if len(parts) < 2 || parts[0] != "PAYLOAD_DATA" || parts[1] != fmt.Sprintf("%x", b.Hash) {
+		return nil, fmt.Errorf("unexpected response %q", firstWord(response))
+	}
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("leader does not have the storage of block %d", b.Index)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(parts[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage for block %d: %w", b.Index, err)
+	}
+
+	var storage Storage
+	if err := storage.Deserialize(data, b.Version); err != nil {
+		return nil, fmt.Errorf("invalid storage for block %d: %w", b.Index, err)
+	}
+	return attachPayload(b, storage)
+}
+
+func handleGetPayload(conn net.Conn, parts []string) {
+	if len(parts) < 2 {
+		return
+	}
+
+	hash, err := DecodeHash(parts[1])
+	if err != nil {
+		fmt.Printf("Hash de bloco inválido: %v\n", err)
+		sendMessage(fmt.Sprintf("PAYLOAD_DATA %s", parts[1]), conn)
+		return
+	}
+
+	r, done, err := localReader()
+	if err != nil {
+		sendMessage(fmt.Sprintf("PAYLOAD_DATA %s", parts[1]), conn)
+		return
+	}
+	defer done()
+
+	b, err := r.ReadBlockByHash(hash)
+	if err != nil || b.HeaderOnly {
+		sendMessage(fmt.Sprintf("PAYLOAD_DATA %s", parts[1]), conn)
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(b.Storage.Serialize(b.Version))
+	sendMessage(fmt.Sprintf("PAYLOAD_DATA %s %s", parts[1], encoded), conn)
+}
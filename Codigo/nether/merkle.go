@@ -0,0 +1,187 @@
+package nether
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Domain separation between leaves and inner nodes of the merkle tree
+const (
+	MERKLE_LEAF_PREFIX byte = 0x00
+	MERKLE_NODE_PREFIX byte = 0x01
+)
+
+// EntryProof proves that a single storage entry belongs to a signed block
+type EntryProof struct {
+	BlockIndex uint64
+	EntryIndex uint64
+	Entry      []byte
+	Path       []Hash
+
+	// Block header needed to recompute the block hash
+	Version    uint8
+	Timestamp  uint64
+	PrevHash   Hash
+	MerkleRoot Hash
+	Hash       Hash
+	Signature  Signature
+	PubKey     PublicKey
+}
+
+// merkleLeaf commits to the position of the entry as well, so a proof cannot
+// be replayed for another index when an odd node is paired with itself
+func merkleLeaf(index uint64, entry []byte) Hash {
+	record := make([]byte, 9, 9+len(entry))
+	record[0] = MERKLE_LEAF_PREFIX
+	binary.LittleEndian.PutUint64(record[1:], index)
+	record = append(record, entry...)
+	return sha256.Sum256(record)
+}
+
+func merkleNode(left Hash, right Hash) Hash {
+	record := make([]byte, 0, 1+2*CIPHER_SIZE)
+	record = append(record, MERKLE_NODE_PREFIX)
+	record = append(record, left[:]...)
+	record = append(record, right[:]...)
+	return sha256.Sum256(record)
+}
+
+// merkleLevels builds every level of the tree, leaves first. An odd node is
+// paired with itself.
+func merkleLevels(entries [][]byte) [][]Hash {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	level := make([]Hash, len(entries))
+	for i, entry := range entries {
+		level[i] = merkleLeaf(uint64(i), entry)
+	}
+
+	levels := [][]Hash{level}
+	for len(level) > 1 {
+		next := make([]Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, merkleNode(level[i], right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// merkleRoot returns the root of the entries, or an empty hash when there are none
+func merkleRoot(entries [][]byte) Hash {
+	levels := merkleLevels(entries)
+	if levels == nil {
+		return Hash{}
+	}
+	return levels[len(levels)-1][0]
+}
+
+// merklePath returns the siblings from the leaf at index up to the root. The
+// side of each sibling follows from the bits of index.
+func merklePath(entries [][]byte, index int) []Hash {
+	path := make([]Hash, 0)
+	levels := merkleLevels(entries)
+
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		path = append(path, level[sibling])
+		index /= 2
+	}
+
+	return path
+}
+
+// ProveEntry builds an inclusion proof for one entry of the block at blockIndex
+func ProveEntry(blockIndex uint64, entryIndex uint64) (*EntryProof, error) {
+	b, err := ReadBlockAt(blockIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Version == BLOCK_VERSION_LEGACY {
+		return nil, fmt.Errorf("block %d uses the legacy format and has no merkle commitment", blockIndex)
+	}
+
+	if b, err = FetchPayload(b); err != nil {
+		return nil, err
+	}
+
+	entries := b.Storage.entries(b.Version)
+	if entryIndex >= uint64(len(entries)) {
+		return nil, fmt.Errorf("block %d has %d entries, entry %d not found", blockIndex, len(entries), entryIndex)
+	}
+
+	return &EntryProof{
+		BlockIndex: b.Index,
+		EntryIndex: entryIndex,
+		Entry:      entries[entryIndex],
+		Path:       merklePath(entries, int(entryIndex)),
+		Version:    b.Version,
+		Timestamp:  b.Timestamp,
+		PrevHash:   b.PrevHash,
+		MerkleRoot: b.MerkleRoot,
+		Hash:       b.Hash,
+		Signature:  b.Signature,
+		PubKey:     b.PubKey,
+	}, nil
+}
+
+// VerifyEntryProof checks the path from the entry to the merkle root, the
+// block hash over the header and the signature of the block
+func VerifyEntryProof(p *EntryProof) error {
+	if p.Version == BLOCK_VERSION_LEGACY {
+		return fmt.Errorf("legacy blocks cannot be proven")
+	}
+
+	node := merkleLeaf(p.EntryIndex, p.Entry)
+	index := p.EntryIndex
+	for _, sibling := range p.Path {
+		if index%2 == 1 {
+			node = merkleNode(sibling, node)
+		} else {
+			node = merkleNode(node, sibling)
+		}
+		index /= 2
+	}
+
+	if index != 0 {
+		return fmt.Errorf("entry index %d out of range for the proof path", p.EntryIndex)
+	}
+
+	if node != p.MerkleRoot {
+		return fmt.Errorf("entry does not lead to the merkle root")
+	}
+
+	b := &Block{
+		Version:    p.Version,
+		Index:      p.BlockIndex,
+		Timestamp:  p.Timestamp,
+		PrevHash:   p.PrevHash,
+		MerkleRoot: p.MerkleRoot,
+		Signature:  p.Signature,
+		PubKey:     p.PubKey,
+	}
+	b.calculateHash()
+
+	if b.Hash != p.Hash {
+		return fmt.Errorf("block header does not match the block hash")
+	}
+
+	if !b.Verify(b.PubKey) {
+		return fmt.Errorf("invalid block signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package nether
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Layout of chain files written before the versioned format
+const (
+	LEGACY_METADATA_SIZE int64 = int64(8 + 8 + 8 + 8 + CIPHER_SIZE)
+	LEGACY_BLOCK_SIZE    int   = 8 + 8 + 8 + CIPHER_SIZE + CIPHER_SIZE + SIGNATURE_SIZE + PUBLIC_KEY_SIZE + EMBEDDING_LEGACY_SIZE + IMAGE_PATH_SIZE
+)
+
+// deserializeLegacyBlock decodes a block with a single embedding and image,
+// keeping its original hash and signature
+func deserializeLegacyBlock(data []byte) (*Block, error) {
+	if len(data) != LEGACY_BLOCK_SIZE {
+		return nil, fmt.Errorf("invalid legacy block size %d", len(data))
+	}
+
+	b := Block{Version: BLOCK_VERSION_LEGACY}
+	buf := bytes.NewReader(data)
+
+	var blockSize uint64
+	binary.Read(buf, binary.LittleEndian, &blockSize)
+	binary.Read(buf, binary.LittleEndian, &b.Index)
+	binary.Read(buf, binary.LittleEndian, &b.Timestamp)
+
+	buf.Read(b.PrevHash[:])
+	buf.Read(b.Hash[:])
+	buf.Read(b.Signature[:])
+	buf.Read(b.PubKey[:])
+
+	embeddingData := make([]byte, EMBEDDING_LEGACY_SIZE)
+	buf.Read(embeddingData)
+	var embedding Embedding
+	if err := embedding.deserializeFor(embeddingData, BLOCK_VERSION_LEGACY); err != nil {
+		return nil, err
+	}
+
+	imageData := make([]byte, IMAGE_PATH_SIZE)
+	buf.Read(imageData)
+	var image Image
+	if err := image.deserializePath(imageData); err != nil {
+		return nil, err
+	}
+
+	b.Storage = *NewStorage([]Embedding{embedding}, []Image{image}, nil)
+	b.MerkleRoot = b.Storage.merkleRoot(b.Version)
+	b.computeSize()
+
+	return &b, nil
+}
+
+// readLegacyChain reads the metadata and every block of a legacy chain file
+func readLegacyChain(file *os.File) (Hash, []*Block, error) {
+	var size, localSize, lastBlockIndex, lastBlockOffset uint64
+	var firstBlockHash Hash
+
+	file.Seek(0, io.SeekStart)
+	binary.Read(file, binary.LittleEndian, &size)
+	binary.Read(file, binary.LittleEndian, &localSize)
+	binary.Read(file, binary.LittleEndian, &lastBlockIndex)
+	if err := binary.Read(file, binary.LittleEndian, &lastBlockOffset); err != nil {
+		return firstBlockHash, nil, fmt.Errorf("cannot read legacy metadata: %w", err)
+	}
+	if err := binary.Read(file, binary.LittleEndian, &firstBlockHash); err != nil {
+		return firstBlockHash, nil, fmt.Errorf("cannot read legacy metadata: %w", err)
+	}
+
+	file.Seek(LEGACY_METADATA_SIZE, io.SeekStart)
+	blocks := make([]*Block, 0)
+	rawBlock := make([]byte, LEGACY_BLOCK_SIZE)
+	for {
+		if _, err := io.ReadFull(file, rawBlock); err != nil {
+			return firstBlockHash, nil, fmt.Errorf("cannot read legacy block %d: %w", len(blocks), err)
+		}
+
+		b, err := deserializeLegacyBlock(rawBlock)
+		if err != nil {
+			return firstBlockHash, nil, fmt.Errorf("cannot decode legacy block %d: %w", len(blocks), err)
+		}
+		blocks = append(blocks, b)
+
+		if b.Index >= lastBlockIndex {
+			break
+		}
+	}
+
+	return firstBlockHash, blocks, nil
+}
+
+// migrateChain rewrites the chain at path into the current format. The old
+// file is kept next to it with a .legacy suffix. It returns false when the
+// chain is already in the current format.
+func migrateChain(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("cannot open blockchain: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(CHAIN_MAGIC))
+	if _, err := io.ReadFull(file, magic); err == nil && string(magic) == CHAIN_MAGIC {
+		r := &NetherReader{file: file}
+		if err := r.ReadMetadata(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	firstBlockHash, blocks, err := readLegacyChain(file)
+	if err != nil {
+		return false, err
+	}
+	file.Close()
+
+	tmpPath := path + ".migrate"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return false, fmt.Errorf("cannot create migrated blockchain: %w", err)
+	}
+
+	r := &NetherReader{
+		path:           tmpPath,
+		file:           out,
+		firstBlockHash: firstBlockHash,
+	}
+	r.WriteMetadata()
+	for _, b := range blocks {
+		if err := r.WriteBlock(b); err != nil {
+			r.Close()
+			os.Remove(tmpPath)
+			os.Remove(tmpPath + INDEX_SUFFIX)
+			return false, fmt.Errorf("cannot write migrated block %d: %w", b.Index, err)
+		}
+	}
+	out.Sync()
+	r.Close()
+
+	if err := verifyChain(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		os.Remove(tmpPath + INDEX_SUFFIX)
+		return false, fmt.Errorf("migrated blockchain is invalid: %w", err)
+	}
+
+	if err := os.Rename(path, path+".legacy"); err != nil {
+		return false, fmt.Errorf("cannot keep legacy blockchain: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return false, fmt.Errorf("cannot replace blockchain: %w", err)
+	}
+	os.Rename(tmpPath+INDEX_SUFFIX, path+INDEX_SUFFIX)
+
+	return true, nil
+}
@@ -0,0 +1,64 @@
+package nether
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The chain shipped in data/ predates the versioned header and is kept in
+// the legacy format as a migration fixture
+const LEGACY_CHAIN_FIXTURE = "../data/nether.chain"
+
+func TestMigrateLegacyChain(t *testing.T) {
+	legacy, err := os.ReadFile(LEGACY_CHAIN_FIXTURE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "nether.chain")
+	if err := os.WriteFile(path, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := migrateChain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Fatal("legacy chain was not migrated")
+	}
+
+	kept, err := os.ReadFile(path + ".legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kept) != string(legacy) {
+		t.Error("legacy chain was not kept unchanged")
+	}
+
+	if err := verifyChain(path); err != nil {
+		t.Fatalf("migrated chain is invalid: %v", err)
+	}
+
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := r.ReadGenesis()
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.Index != 0 {
+		t.Errorf("first migrated block has index %d", genesis.Index)
+	}
+
+	migrated, err = migrateChain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated {
+		t.Error("chain in the current format was migrated again")
+	}
+}
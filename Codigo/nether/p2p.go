@@ -2,19 +2,13 @@ package nether
 
 import (
 	"fmt"
-	"math/rand"
 	"net"
-	"strings"
 	"time"
 )
 
 const (
 	SERVER_ADRESS string = "data/server.conf"
 	SERVER_PORT   string = "666"
-	HEADER_SIZE   int    = 128
-	BUFFER_SIZE          = 4096
-	PAYLOAD_SIZE         = BUFFER_SIZE - 128
-	MESSAGE_END          = "<END_OF_MESSAGE>"
 )
 
 var (
@@ -83,56 +77,95 @@ func connect(ipv6 string) (net.Conn, error) {
 	}
 
 	fmt.Printf("Conexao tcp realizada com %v\n", serverAddress)
-	return clientHandle(conn), nil
+	return clientHandle(conn)
 }
 
-func serverHandle(conn net.Conn) {
-	name, _ := readMessage(conn)
-	sendSelfId(conn)
+func serverHandle(raw net.Conn) {
+	secure, name, err := authenticateDialer(raw)
+	if err != nil {
+		fmt.Printf("Autenticação do peer %s falhou: %v\n", raw.RemoteAddr(), err)
+		raw.Close()
+		return
+	}
+	conn := newPeerConn(secure)
+
+	// The other end of the connection of a leader to itself, already registered
+	// on the side that dialed
+	if name == EncodePublicKey(userdata.Key.Pk) {
+		startChat(conn)
+		return
+	}
 
+	role := ROLE_CLIENT
 	if i_am_leader {
 		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 		if ip == self_ipv6 {
-			addLeader(name, conn)
+			role = ROLE_LEADER
 		} else {
-			addNode(name, conn)
+			role = ROLE_NODE
 		}
-		startChat(conn, removeNode)
-	} else {
-		addClient(name, conn)
-		startChat(conn, removeClient)
 	}
-}
-
-func clientHandle(conn net.Conn) net.Conn {
-	sendSelfId(conn)
-	name, _ := readMessage(conn)
 
-	addClient(name, conn)
-	return conn
+	if _, added := peer_manager.Add(name, conn, role, PEER_INBOUND); !added {
+		fmt.Printf("Peer %s já conectado, conexão duplicada descartada\n", name[0:10])
+		return
+	}
+	startChat(conn)
 }
 
-func sendSelfId(conn net.Conn) error {
-	message := EncodePublicKey(userdata.Key.Pk)
-
-	err := sendMessage(message, conn)
+// clientHandle authenticates a connection we dialed and starts reading it.
+// When we were already connected to that peer, the connection kept is returned.
+func clientHandle(raw net.Conn) (net.Conn, error) {
+	secure, name, err := authenticateListener(raw)
 	if err != nil {
-		fmt.Printf("Erro ao enviar SelfID: %v\n", err)
-		return err
+		fmt.Printf("Autenticação do servidor %s falhou: %v\n", raw.RemoteAddr(), err)
+		raw.Close()
+		return nil, err
 	}
+	conn := newPeerConn(secure)
 
-	return nil
+	kept, added := peer_manager.Add(name, conn, ROLE_CLIENT, PEER_OUTBOUND)
+	if !added {
+		fmt.Printf("Peer %s já conectado, usando a conexão existente\n", name[0:10])
+		return kept, nil
+	}
+
+	go startChat(conn)
+	return conn, nil
 }
 
-func startChat(conn net.Conn, remove func(conn net.Conn)) error {
-	defer remove(conn)
+// startChat reads the frames of conn until it is closed: messages and requests
+// go to the handlers, responses to the request waiting for them. The
+// connection is closed on return, which also stops its writer.
+func startChat(conn net.Conn) error {
+	defer failPending(conn)
+	defer conn.Close()
+	defer peer_manager.Remove(conn)
 
 	for {
-		msg, err := readMessage(conn)
+		frameType, payload, err := readFrame(conn, MAX_FRAME_SIZE)
 		if err != nil {
 			break
 		}
-		go dealWithRequisition(msg, conn)
+		peer_manager.Touch(conn)
+
+		switch frameType {
+		case FRAME_MESSAGE:
+			go dealWithRequisition(string(payload), conn)
+		case FRAME_REQUEST, FRAME_RESPONSE:
+			id, message, err := parseRPCPayload(payload)
+			if err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				continue
+			}
+			if frameType == FRAME_RESPONSE {
+				deliverResponse(conn, id, message)
+			} else {
+				go dealWithRequisition(message, &replyConn{Conn: conn, id: id})
+			}
+		default:
+			fmt.Printf("[ERROR] Frame de tipo desconhecido %#x ignorado\n", frameType)
+		}
 	}
 
 	return nil
@@ -192,99 +225,19 @@ func ProcessIpv6(ipv6Address string) (string, error) {
 	return listenAddress, nil
 }
 
+// sendMessage sends a text command; through the replyConn of a request it is
+// sent as the response to that request
 func sendMessage(message string, conn net.Conn) error {
-	messageID := rand.Int63() // Gera um ID único para a mensagem
-	// Dividir a mensagem em fragmentos
-	fragments := []string{}
-	for len(message) > 0 {
-		if len(message) > PAYLOAD_SIZE {
-			fragments = append(fragments, message[:PAYLOAD_SIZE])
-			message = message[PAYLOAD_SIZE:]
-		} else {
-			fragments = append(fragments, message)
-			message = ""
-		}
-	}
-	totalFragments := len(fragments)
-	// Enviar cada fragmento com cabeçalhos
-	for i, fragment := range fragments {
-		header := fmt.Sprintf("ID:%d PART:%d/%d ", messageID, i+1, totalFragments)
-		paddedFragment := fragment + MESSAGE_END
-		padding := PAYLOAD_SIZE - len(fragment)
-		paddedFragment += strings.Repeat(" ", padding)
-
-		fullMessage := header + paddedFragment
-		_, err := conn.Write([]byte(fullMessage))
-		if err != nil {
-			fmt.Printf("[ERROR] Erro ao enviar fragmento %d: %v\n", i+1, err)
-			return fmt.Errorf("erro ao enviar fragmento %d: %v", i+1, err)
-		}
-	}
-	return nil
-}
-
-func readMessage(conn net.Conn) (string, error) {
-	messageParts := make(map[int]string)
-	var messageID int64
-	var totalFragments int
-
-	for {
-		buffer := make([]byte, BUFFER_SIZE)
-		n, err := conn.Read(buffer)
-		if err != nil {
-			return "", err
-		}
-
-		message := string(buffer[:n])
-
-		// Localizar o delimitador de fim de mensagem
-		endIndex := strings.Index(message, MESSAGE_END)
-		if endIndex == -1 {
-			fmt.Printf("[ERROR] Delimitador %q não encontrado na mensagem\n", MESSAGE_END)
-			return "", fmt.Errorf("delimitador %q não encontrado na mensagem", MESSAGE_END)
-		}
-
-		// Remover padding extra
-		message = strings.TrimSpace(message[:endIndex])
-
-		// Separar cabeçalho e corpo
-		headerEnd := strings.Index(message, " ")
-		if headerEnd == -1 {
-			fmt.Println("[ERROR] Cabeçalho inválido ou mensagem incompleta")
-			return "", fmt.Errorf("cabeçalho inválido ou mensagem incompleta")
-		}
-
-		header := message[:headerEnd]
-		body := message[headerEnd+1:]
-
-		// Parse do cabeçalho completo
-		var partNumber int
-		_, err = fmt.Sscanf(header+" "+body, "ID:%d PART:%d/%d", &messageID, &partNumber, &totalFragments)
-		if err != nil {
-			fmt.Printf("[ERROR] Erro ao parsear cabeçalho: %v\n", err)
-			return "", fmt.Errorf("erro ao parsear cabeçalho: %v", err)
-		}
-
-		// Salvar a parte da mensagem
-		messageParts[partNumber] = body[strings.Index(body, " ")+1:]
-
-		// Verificar se todas as partes foram recebidas
-		if len(messageParts) == totalFragments {
-			break
-		}
+	var err error
+	if reply, ok := conn.(*replyConn); ok {
+		err = writeFrame(reply.Conn, FRAME_RESPONSE, rpcPayload(reply.id, message))
+	} else {
+		err = writeFrame(conn, FRAME_MESSAGE, []byte(message))
 	}
 
-	// Reconstituir a mensagem
-	var reconstructedMessage strings.Builder
-	for i := 1; i <= totalFragments; i++ {
-		part, exists := messageParts[i]
-		if !exists {
-			fmt.Printf("[ERROR] Fragmento %d está faltando\n", i)
-			return "", fmt.Errorf("fragmento %d está faltando", i)
-		}
-		reconstructedMessage.WriteString(part)
+	if err != nil {
+		fmt.Printf("[ERROR] Erro ao enviar mensagem: %v\n", err)
+		return fmt.Errorf("erro ao enviar mensagem: %w", err)
 	}
-
-	finalMessage := reconstructedMessage.String()
-	return finalMessage, nil
+	return nil
 }
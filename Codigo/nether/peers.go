@@ -0,0 +1,207 @@
+package nether
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PeerRole uint8
+
+const (
+	ROLE_CLIENT PeerRole = 0
+	ROLE_LEADER PeerRole = 1
+	ROLE_NODE   PeerRole = 2
+)
+
+type PeerDirection uint8
+
+const (
+	PEER_INBOUND  PeerDirection = 0 // the peer dialed us
+	PEER_OUTBOUND PeerDirection = 1 // we dialed the peer
+)
+
+// Peer is a connected identity, the proven public key of the handshake
+type Peer struct {
+	Identity  string
+	Role      PeerRole
+	Address   string
+	Direction PeerDirection
+	Connected time.Time
+	LastSeen  time.Time
+
+	conn net.Conn
+}
+
+// PeerManager holds one connection per identity. A peer connected twice keeps
+// a single connection, chosen the same way on both sides so they never drop
+// different ones.
+type PeerManager struct {
+	mu    sync.Mutex
+	peers map[string]*Peer
+	conns map[net.Conn]string
+}
+
+var peer_manager = newPeerManager()
+
+func newPeerManager() *PeerManager {
+	return &PeerManager{
+		peers: make(map[string]*Peer),
+		conns: make(map[net.Conn]string),
+	}
+}
+
+// keepNew decides between the connection of a peer and a new one to the same
+// identity. A redial in the same direction replaces the old connection; when
+// both sides dialed each other the one dialed by the smaller identity stays.
+func keepNew(self string, old *Peer, direction PeerDirection) bool {
+	if old.Direction == direction {
+		return true
+	}
+
+	dialedBySelf := direction == PEER_OUTBOUND
+	return dialedBySelf == (self < old.Identity)
+}
+
+// Add registers conn as the connection of identity and returns the connection
+// kept for it. When the existing connection is kept, conn is closed and added
+// is false. A duplicate connection never demotes a leader.
+func (m *PeerManager) Add(identity string, conn net.Conn, role PeerRole, direction PeerDirection) (kept net.Conn, added bool) {
+	self := ""
+	if userdata != nil {
+		self = EncodePublicKey(userdata.Key.Pk)
+	}
+
+	m.mu.Lock()
+	old, exists := m.peers[identity]
+	if exists && !keepNew(self, old, direction) {
+		m.mu.Unlock()
+		conn.Close()
+		return old.conn, false
+	}
+
+	now := time.Now()
+	peer := &Peer{
+		Identity:  identity,
+		Role:      role,
+		Address:   conn.RemoteAddr().String(),
+		Direction: direction,
+		Connected: now,
+		LastSeen:  now,
+		conn:      conn,
+	}
+	if exists {
+		if old.Role == ROLE_LEADER {
+			peer.Role = ROLE_LEADER
+		}
+		delete(m.conns, old.conn)
+	}
+	m.peers[identity] = peer
+	m.conns[conn] = identity
+	m.mu.Unlock()
+
+	if exists {
+		old.conn.Close()
+	}
+	return conn, true
+}
+
+// Remove forgets conn, if it is still the connection of its peer
+func (m *PeerManager) Remove(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	identity, exists := m.conns[conn]
+	if !exists {
+		return
+	}
+	delete(m.conns, conn)
+	delete(m.peers, identity)
+}
+
+// Disconnect forgets conn and closes it
+func (m *PeerManager) Disconnect(conn net.Conn) {
+	m.Remove(conn)
+	conn.Close()
+}
+
+func (m *PeerManager) SetRole(conn net.Conn, role PeerRole) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if identity, exists := m.conns[conn]; exists {
+		m.peers[identity].Role = role
+	}
+}
+
+// Touch records that something was received from conn
+func (m *PeerManager) Touch(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if identity, exists := m.conns[conn]; exists {
+		m.peers[identity].LastSeen = time.Now()
+	}
+}
+
+// Any returns the connection of some peer with role
+func (m *PeerManager) Any(role PeerRole) (net.Conn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, peer := range m.peers {
+		if peer.Role == role {
+			return peer.conn, true
+		}
+	}
+	return nil, false
+}
+
+// Conns returns the connections of the peers with role, to be used without the lock
+func (m *PeerManager) Conns(role PeerRole) []net.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conns := make([]net.Conn, 0, len(m.peers))
+	for _, peer := range m.peers {
+		if peer.Role == role {
+			conns = append(conns, peer.conn)
+		}
+	}
+	return conns
+}
+
+// AllConns returns the connections of every peer
+func (m *PeerManager) AllConns() []net.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conns := make([]net.Conn, 0, len(m.conns))
+	for conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (m *PeerManager) Count(role PeerRole) int {
+	return len(m.Conns(role))
+}
+
+// List returns a copy of every peer, ordered by role and identity
+func (m *PeerManager) List() []Peer {
+	m.mu.Lock()
+	peers := make([]Peer, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, *peer)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Role != peers[j].Role {
+			return peers[i].Role < peers[j].Role
+		}
+		return peers[i].Identity < peers[j].Identity
+	})
+	return peers
+}
@@ -1,77 +1,289 @@
 package nether
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"sort"
 )
 
 const (
 	LOG_PATH string = "data/program.log"
+
+	// Keystore header: magic, version and the KDF parameters used to derive the key
+	KEYSTORE_MAGIC       string = "NTKS"
+	KEYSTORE_VERSION     uint8  = 1
+	KEYSTORE_HEADER_SIZE int    = 4 + 1 + 1 + 4 + 4 + KDF_SALT_SIZE
+
+	// The keystore file holds one sealed entry per identity. Files with a single
+	// entry, from before identities were named, are read as DEFAULT_IDENTITY.
+	KEYSTORE_IDENTITIES_VERSION uint8  = 2
+	DEFAULT_IDENTITY            string = "default"
 )
 
+var identityName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
 type UserData struct {
-	Hash Hash
+	Name string `json:"-"`
+	Hash Hash   `json:"-"` // keystore key derived from the password, never written to disk
 	Key  Key
+
+	kdf kdfParams
+}
+
+type keystore struct {
+	Default    string            `json:"default"`
+	Identities map[string][]byte `json:"identities"`
+}
+
+func register(name string, password string) (*UserData, error) {
+	return addIdentity(name, password, *NewKey())
 }
 
-func register(password string) *UserData {
+// addIdentity stores k as the new identity name, encrypted with password.
+// Existing identities are never overwritten.
+func addIdentity(name string, password string, k Key) (*UserData, error) {
+	if !identityName.MatchString(name) {
+		return nil, fmt.Errorf("invalid identity name %q, use up to 32 letters, digits, _ or -", name)
+	}
+
+	ks, err := readKeystore()
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := ks.Identities[name]; exists {
+		return nil, fmt.Errorf("identity %s already exists", name)
+	}
+
+	params := newKdfParams()
 	m := &UserData{
-		Hash: HashPassword(password),
-		Key:  *NewKey(),
+		Name: name,
+		Hash: params.deriveKey(password),
+		Key:  k,
+		kdf:  params,
+	}
+
+	if err := SaveConfig(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// readKeystore returns the identities stored in USERDATA_PATH, none when the file does not exist
+func readKeystore() (*keystore, error) {
+	ks := &keystore{Identities: make(map[string][]byte)}
+
+	data, err := os.ReadFile(USERDATA_PATH)
+	if errors.Is(err, os.ErrNotExist) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao abrir arquivo: %w", err)
+	}
+
+	prefix := len(KEYSTORE_MAGIC) + 1
+	if len(data) < prefix || string(data[:len(KEYSTORE_MAGIC)]) != KEYSTORE_MAGIC || data[len(KEYSTORE_MAGIC)] != KEYSTORE_IDENTITIES_VERSION {
+		ks.Default = DEFAULT_IDENTITY
+		ks.Identities[DEFAULT_IDENTITY] = data
+		return ks, nil
+	}
+
+	if err := json.Unmarshal(data[prefix:], ks); err != nil {
+		return nil, fmt.Errorf("cannot decode keystore: %w", err)
+	}
+	if ks.Identities == nil {
+		ks.Identities = make(map[string][]byte)
+	}
+	return ks, nil
+}
+
+func writeKeystore(ks *keystore) error {
+	body, err := json.Marshal(ks)
+	if err != nil {
+		return err
+	}
+	data := append([]byte(KEYSTORE_MAGIC), KEYSTORE_IDENTITIES_VERSION)
+	data = append(data, body...)
+
+	// Write to a temporary file first so an interrupted save keeps the old keystore
+	tmpPath := USERDATA_PATH + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, USERDATA_PATH)
+}
+
+// identities returns the names in the keystore, sorted, and the default one
+func identities() ([]string, string, error) {
+	ks, err := readKeystore()
+	if err != nil {
+		return nil, "", err
 	}
 
-	SaveConfig(m)
+	names := make([]string, 0, len(ks.Identities))
+	for name := range ks.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	return m
+	return names, ks.Default, nil
 }
 
-// SaveConfig save metadatas on file using AES with GCM mode
-func SaveConfig(m *UserData) {
-	file, err := os.OpenFile(USERDATA_PATH, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+// setDefaultIdentity chooses the identity loaded when no name is given
+func setDefaultIdentity(name string) error {
+	ks, err := readKeystore()
 	if err != nil {
-		panic(fmt.Errorf("cannot save configurations: %w", err))
+		return err
+	}
+	if _, exists := ks.Identities[name]; !exists {
+		return fmt.Errorf("identity %s not found", name)
 	}
-	defer file.Close()
 
+	ks.Default = name
+	return writeKeystore(ks)
+}
+
+func (p kdfParams) keystoreHeader() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(KEYSTORE_MAGIC)
+	buf.WriteByte(KEYSTORE_VERSION)
+	buf.WriteByte(p.LogN)
+	binary.Write(&buf, binary.LittleEndian, p.R)
+	binary.Write(&buf, binary.LittleEndian, p.P)
+	buf.Write(p.Salt[:])
+
+	return buf.Bytes()
+}
+
+// parseKeystoreHeader returns false for entries written before the keystore was versioned
+func parseKeystoreHeader(data []byte) (kdfParams, bool, error) {
+	var p kdfParams
+	if len(data) < KEYSTORE_HEADER_SIZE || string(data[:len(KEYSTORE_MAGIC)]) != KEYSTORE_MAGIC {
+		return p, false, nil
+	}
+
+	buf := bytes.NewReader(data[len(KEYSTORE_MAGIC):KEYSTORE_HEADER_SIZE])
+	version, _ := buf.ReadByte()
+	if version != KEYSTORE_VERSION {
+		return p, true, fmt.Errorf("unsupported keystore version %d", version)
+	}
+	p.LogN, _ = buf.ReadByte()
+	binary.Read(buf, binary.LittleEndian, &p.R)
+	binary.Read(buf, binary.LittleEndian, &p.P)
+	buf.Read(p.Salt[:])
+
+	return p, true, p.validate()
+}
+
+// SaveConfig save metadatas of the identity m.Name using AES with GCM mode,
+// keyed by the password KDF. The header is authenticated along with the
+// ciphertext. The other identities of the keystore are kept.
+func SaveConfig(m *UserData) error {
 	jsonData, _ := json.Marshal(*m)
+	header := m.kdf.keystoreHeader()
 
 	// Create a new AES cipher using GCM mode
 	block, _ := aes.NewCipher(m.Hash[:])
 	aesGCM, _ := cipher.NewGCM(block)
 	nonce := make([]byte, aesGCM.NonceSize())
 	io.ReadFull(rand.Reader, nonce)
-	ciphertext := aesGCM.Seal(nil, nonce, jsonData, nil)
+	ciphertext := aesGCM.Seal(nil, nonce, jsonData, header)
+
+	ks, err := readKeystore()
+	if err != nil {
+		return fmt.Errorf("cannot save configurations: %w", err)
+	}
+	ks.Identities[m.Name] = append(append(header, nonce...), ciphertext...)
+	if ks.Default == "" {
+		ks.Default = m.Name
+	}
 
-	file.Write(nonce)
-	file.Write(ciphertext)
+	if err := writeKeystore(ks); err != nil {
+		return fmt.Errorf("cannot save configurations: %w", err)
+	}
+	return nil
 }
 
-func LoadConfig(password string) (bool, *UserData) {
-	file, err := os.Open(USERDATA_PATH)
+func openKeystore(key Hash, data []byte, header []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(key[:])
+	aesGCM, _ := cipher.NewGCM(block)
+	if len(data) < aesGCM.NonceSize() {
+		return nil, fmt.Errorf("truncated keystore")
+	}
+
+	nonce, ciphertext := data[:aesGCM.NonceSize()], data[aesGCM.NonceSize():]
+	return aesGCM.Open(nil, nonce, ciphertext, header)
+}
+
+// LoadConfig deciphers the identity name with password, the default identity
+// when name is empty. Entries in the legacy format, keyed by a bare SHA-256 of
+// the password, are rewritten in the current one, as are keys stored without
+// the leading zeros of their fields.
+func LoadConfig(name string, password string) (bool, *UserData) {
+	ks, err := readKeystore()
+	if err != nil {
+		panic(err)
+	}
+
+	if name == "" {
+		name = ks.Default
+	}
+	data, exists := ks.Identities[name]
+	if !exists {
+		fmt.Printf("Identidade %s não encontrada\n", name)
+		return false, nil
+	}
+
+	params, versioned, err := parseKeystoreHeader(data)
 	if err != nil {
-		panic(fmt.Errorf("erro ao abrir arquivo: %w", err))
+		fmt.Printf("Arquivo de configuração inválido: %v\n", err)
+		return false, nil
 	}
-	defer file.Close()
 
 	// Decipher text using password
-	hash := HashPassword(password)
-	block, _ := aes.NewCipher(hash[:])
-	aesGCM, _ := cipher.NewGCM(block)
-	nonce := make([]byte, aesGCM.NonceSize())
-	io.ReadFull(file, nonce)
-	ciphertext, _ := io.ReadAll(file)
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	var key Hash
+	var plaintext []byte
+	if versioned {
+		key = params.deriveKey(password)
+		plaintext, err = openKeystore(key, data[KEYSTORE_HEADER_SIZE:], data[:KEYSTORE_HEADER_SIZE])
+	} else {
+		key = HashPassword(password)
+		plaintext, err = openKeystore(key, data, nil)
+	}
 	if err != nil {
 		return false, nil
 	}
 
 	// Recover metadata
-	m := &UserData{}
+	m := &UserData{Name: name, Hash: key, kdf: params}
 	json.Unmarshal(plaintext, &m)
+
+	repaired, err := m.Key.repair()
+	if err != nil {
+		fmt.Printf("[AVISO] A chave de %s está corrompida, seus blocos não serão válidos: %v\n", name, err)
+	} else if repaired {
+		fmt.Printf("Corrigindo a chave de %s, gerada sem os zeros iniciais\n", name)
+	}
+
+	if !versioned {
+		fmt.Printf("Atualizando %s para o formato com KDF\n", USERDATA_PATH)
+		m.kdf = newKdfParams()
+		m.Hash = m.kdf.deriveKey(password)
+	}
+	if repaired || !versioned {
+		if err := SaveConfig(m); err != nil {
+			fmt.Printf("Erro ao atualizar %s: %v\n", USERDATA_PATH, err)
+		}
+	}
+
 	return true, m
 }
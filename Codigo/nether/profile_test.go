@@ -0,0 +1,24 @@
+package nether
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSaveConfigReturnsKeystoreErrors(t *testing.T) {
+	useTempDir(t)
+
+	// A directory in place of the keystore can be neither read nor replaced
+	if err := os.Mkdir(USERDATA_PATH, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	params := newKdfParams()
+	m := &UserData{Name: "test", Hash: params.deriveKey("password"), Key: *NewKey(), kdf: params}
+	if err := SaveConfig(m); err == nil {
+		t.Fatal("SaveConfig succeeded without a keystore file")
+	}
+	if _, err := register("other", "password"); err == nil {
+		t.Fatal("register succeeded without a keystore file")
+	}
+}
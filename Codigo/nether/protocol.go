@@ -1,6 +1,7 @@
 package nether
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -8,19 +9,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	DOWNLOAD_PATH string = BLOCKCHAIN_PATH + ".download"
 )
 
 var (
 	i_am_leader = false
 
-	clients = make(map[net.Conn]string)
-	leaders = make(map[net.Conn]string)
-	nodes   = make(map[net.Conn]string)
-
-	clients_lock sync.Mutex
-	leaders_lock sync.Mutex
-	nodes_lock   sync.Mutex
-
 	handlers map[string]func(conn net.Conn, parts []string)
 
 	under_election    = false
@@ -36,23 +34,40 @@ var (
 
 func initHandlers() {
 	handlers = map[string]func(conn net.Conn, parts []string){
-		"LEADER?":         handleLeaderRequisition,
-		"PING":            handlePing,
-		"PONG":            func(conn net.Conn, parts []string) {},
-		"ELECTION":        handleElection,
-		"NEW_ELECTION":    handleElectionPreparing,
-		"ELECTED":         handleElected,
-		"WIN_ADVICE":      handleWinAdvice,
-		"WIN":             handleWin,
-		"WIN_ACCEPTED":    handleWinAccepted,
-		"WIN_REJECTED":    handleWinRejected,
-		"GET_BLOCKCHAIN":  handleGetBlockchain,
-		"BLOCKCHAIN_DATA": handleBlockchainData,
+		"LEADER?":        handleLeaderRequisition,
+		"PING":           handlePing,
+		"PONG":           func(conn net.Conn, parts []string) {},
+		"ELECTION":       handleElection,
+		"NEW_ELECTION":   handleElectionPreparing,
+		"ELECTED":        handleElected,
+		"WIN_ADVICE":     handleWinAdvice,
+		"WIN":            handleWin,
+		"WIN_ACCEPTED":   handleWinAccepted,
+		"WIN_REJECTED":   handleWinRejected,
+		"GET_IMAGE":      handleGetImage,
+		"CHECKPOINT":     handleCheckpoint,
+		"GET_CHECKPOINT": handleGetCheckpoint,
+		"GET_BLOCKS":     handleGetBlocks,
+		"GET_PAYLOAD":    handleGetPayload,
+
+		// Data is only accepted as the response to a request, see request
+		"IMAGE_DATA":      handleUnsolicited,
+		"CHECKPOINT_DATA": handleUnsolicited,
+		"BLOCKS_DATA":     handleUnsolicited,
+		"PAYLOAD_DATA":    handleUnsolicited,
 	}
 }
 
+// handleUnsolicited drops data that no request of this node asked for
+func handleUnsolicited(conn net.Conn, parts []string) {
+	fmt.Printf("%s de %s sem requisição pendente, descartando\n", parts[0], conn.RemoteAddr())
+}
+
 func dealWithRequisition(message string, conn net.Conn) {
 	parts := strings.Fields(message)
+	if len(parts) == 0 {
+		return
+	}
 	command := parts[0]
 
 	if handler, exists := handlers[command]; exists {
@@ -68,7 +83,11 @@ func handleLeaderRequisition(conn net.Conn, parts []string) {
 		fmt.Printf("Respondendo que sou lider\n")
 		sendMessage("YES", conn)
 	} else {
-		leader, _, _ := getAny(leaders)
+		leader, exists := peer_manager.Any(ROLE_LEADER)
+		if !exists {
+			fmt.Printf("Nenhum líder conectado para indicar\n")
+			return
+		}
 		ipv6 := getIPv6(leader)
 		fmt.Printf("Respondendo que não sou lider, ip do lider sendo enviado: %s\n", ipv6)
 		sendMessage(ipv6, conn)
@@ -84,6 +103,7 @@ func StartAsLeader() error {
 	i_am_leader = true
 	fmt.Printf("Iniciando e se auto intitulando lider da nova rede\n")
 
+	go checkpointLoop()
 	return startServer()
 }
 
@@ -98,11 +118,12 @@ func EnterToNetwork(ipv6 string) error {
 	}
 
 	fmt.Printf("Conexão realizada, pergutando se é lider\n")
-	sendMessage("LEADER?", conn)
-	response, err := readMessage(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+	response, err := request(ctx, conn, "LEADER?")
 	if err != nil {
 		fmt.Printf("erro %v\n", err)
-		disconnectClient(conn)
+		peer_manager.Disconnect(conn)
 		return err
 	}
 
@@ -110,7 +131,7 @@ func EnterToNetwork(ipv6 string) error {
 		fmt.Printf("É lider, salvando\n")
 		clientToLeader(conn)
 	} else {
-		disconnectClient(conn)
+		peer_manager.Disconnect(conn)
 		leader_ipv6 := response
 		fmt.Printf("Não é lider, novo endereço de lider recebido como resposta: %v\n", leader_ipv6)
 		conn, err = connect(leader_ipv6)
@@ -128,34 +149,23 @@ func EnterToNetwork(ipv6 string) error {
 		}
 	}()
 
-	fmt.Printf("Abrindo e mantendo a conexão com o novo lider\n")
-	go startChat(conn, removeLeader)
-
 	return nil
 }
 
 func broadcast(message string) {
-	for conn := range clients {
-		sendMessage(message, conn)
-	}
-
-	for conn := range leaders {
-		sendMessage(message, conn)
-	}
-
-	for conn := range nodes {
+	for _, conn := range peer_manager.AllConns() {
 		sendMessage(message, conn)
 	}
 }
 
 func broadcastLeaders(message string) {
-	for conn := range leaders {
+	for _, conn := range peer_manager.Conns(ROLE_LEADER) {
 		sendMessage(message, conn)
 	}
 }
 
 func broadcastNodes(message string) {
-	for conn := range nodes {
+	for _, conn := range peer_manager.Conns(ROLE_NODE) {
 		sendMessage(message, conn)
 	}
 }
@@ -201,7 +211,11 @@ func handleElection(conn net.Conn, parts []string) {
 	if found {
 		fmt.Printf("Eu fui o ganhador! nonce: %16s, hash: %s\n", nonce, getHash(election_message, nonce))
 		message := fmt.Sprintf("WIN %s", nonce)
-		leader, _, _ := getAny(leaders)
+		leader, exists := peer_manager.Any(ROLE_LEADER)
+		if !exists {
+			fmt.Printf("Nenhum líder conectado para receber o WIN\n")
+			return
+		}
 		sendMessage(message, leader)
 	}
 }
@@ -279,8 +293,8 @@ func handleElected(conn net.Conn, parts []string) {
 	new_leaders = make([]string, 0)
 
 	fmt.Printf("Desconectando de outros lideres.\n")
-	for leader_conn := range leaders {
-		disconnectLeader(leader_conn)
+	for _, leader_conn := range peer_manager.Conns(ROLE_LEADER) {
+		peer_manager.Disconnect(leader_conn)
 	}
 
 	if become_leader_after_election {
@@ -300,89 +314,145 @@ func handleElected(conn net.Conn, parts []string) {
 		new_leader, _ := chooseRandom(new_leaders)
 		fmt.Printf("Conectando a: %s\n", new_leader)
 		new_leader_conn, err := connect(new_leader)
-		clientToLeader(new_leader_conn)
 		if err == nil {
-			go startChat(new_leader_conn, removeLeader)
+			clientToLeader(new_leader_conn)
 		}
 	} else {
 		fmt.Printf("Nao sou lider e estou escolhendo um lider aleatorio para conectar\n")
 		for _, leader := range new_leaders {
 			fmt.Printf("Conectando a: %s\n", leader)
 			new_leader_conn, err := connect(leader)
-			clientToLeader(new_leader_conn)
 			if err == nil {
-				go startChat(new_leader_conn, removeLeader)
+				clientToLeader(new_leader_conn)
 			}
 		}
 	}
 }
 
 func ShowConnections() error {
-	for conn, name := range clients {
-		fmt.Printf("clients = name: %s | conn %s\n", name[0:10], conn.RemoteAddr())
+	for _, peer := range peer_manager.List() {
+		fmt.Printf("%-6s = name: %s | conn %s | %-8s | last seen %s ago\n", peer.Role, peer.Identity[0:10], peer.Address, peer.Direction, time.Since(peer.LastSeen).Round(time.Second))
 	}
-	for conn, name := range leaders {
-		fmt.Printf("leaders = name: %s | conn %s\n", name[0:10], conn.RemoteAddr())
-	}
-	for conn, name := range nodes {
-		fmt.Printf("nodes   = name: %s | conn %s\n", name[0:10], conn.RemoteAddr())
+	return nil
+}
+
+func ShowQueues() error {
+	for _, q := range QueueMetrics() {
+		fmt.Printf("%s | queue %d/%d | max %d | sent %d | stalls %d\n", q.Peer, q.Depth, q.Capacity, q.MaxDepth, q.Sent, q.Stalls)
 	}
 	return nil
 }
 
-func handleGetBlockchain(conn net.Conn, parts []string) {
-	fmt.Printf("Solicitação de blockchain recebida, enviando arquivo...\n")
-	filePath := "data/nether.chain"
-	data, err := os.ReadFile(filePath)
+// DownloadBlockchain replaces the local chain with the one of a leader, once
+// verified. The blocks are downloaded in batches, see handleGetBlocks.
+func DownloadBlockchain(ctx context.Context) error {
+	leaderConn, leaderExists := peer_manager.Any(ROLE_LEADER)
+	if !leaderExists {
+		return fmt.Errorf("no leader available to request the blockchain")
+	}
+
+	fmt.Printf("Solicitando blockchain ao líder: %s\n", leaderConn.RemoteAddr())
+	downloaded, err := downloadChain(ctx, leaderConn, DOWNLOAD_PATH, 0, false, func(b *Block) error {
+		if reason := verifyBlock(b, 0, b.PrevHash); reason != "" {
+			return fmt.Errorf("invalid genesis: %s", reason)
+		}
+		return nil
+	})
 	if err != nil {
-		fmt.Printf("Erro ao ler arquivo blockchain: %v\n", err)
-		return
+		return err
 	}
+	downloaded.Close()
 
-	encodedData := base64.StdEncoding.EncodeToString(data)
-	sendMessage(fmt.Sprintf("BLOCKCHAIN_DATA %s", encodedData), conn)
+	fmt.Printf("Recebendo e salvando o arquivo blockchain...\n")
+	if err := installChainFile(DOWNLOAD_PATH); err != nil {
+		return err
+	}
+
+	fmt.Printf("Blockchain salva com sucesso!\n")
+	return nil
 }
 
-func handleBlockchainData(conn net.Conn, parts []string) {
-	if len(parts) < 2 {
-		fmt.Printf("Dados da blockchain recebidos em formato inválido\n")
-		return
+// installChainFile verifies the chain file at tmpPath and loads it in place of
+// the local chain. The loaded chain is closed before its files are replaced.
+func installChainFile(tmpPath string) error {
+	if err := verifyChain(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		os.Remove(tmpPath + INDEX_SUFFIX)
+		return fmt.Errorf("downloaded blockchain is invalid: %w", err)
 	}
 
-	// Reconstruir os dados da mensagem
-	dataStr := strings.Join(parts[1:], " ")
-	dataStr = strings.TrimSpace(dataStr) // Remover espaços extras
+	return replaceChain(func() (ChainStore, error) {
+		// The received chain is a single file, the old segments no longer belong to it
+		if err := removeSegments(BLOCKCHAIN_PATH); err != nil {
+			return nil, fmt.Errorf("cannot remove old segments: %w", err)
+		}
+		if err := os.Rename(tmpPath, BLOCKCHAIN_PATH); err != nil {
+			return nil, fmt.Errorf("cannot save downloaded blockchain: %w", err)
+		}
+		os.Rename(tmpPath+INDEX_SUFFIX, BLOCKCHAIN_PATH+INDEX_SUFFIX)
+		return NewReader()
+	})
+}
 
-	fmt.Printf("Recebendo e salvando o arquivo blockchain...\n")
+func handleGetImage(conn net.Conn, parts []string) {
+	if len(parts) < 2 {
+		fmt.Printf("Pedido de imagem recebido em formato inválido\n")
+		sendMessage("IMAGE_DATA", conn)
+		return
+	}
 
-	// Decodificar os dados
-	data, err := base64.StdEncoding.DecodeString(dataStr)
+	hash, err := DecodeHash(parts[1])
 	if err != nil {
-		fmt.Printf("Erro ao decodificar dados do arquivo: %v\n", err)
+		fmt.Printf("Hash de imagem inválido: %v\n", err)
+		sendMessage(fmt.Sprintf("IMAGE_DATA %s", parts[1]), conn)
 		return
 	}
 
-	// Salvar o arquivo
-	filePath := "data/nether.chain"
-	err = os.WriteFile(filePath, data, 0644)
+	fmt.Printf("Solicitação da imagem %s recebida, enviando...\n", parts[1])
+	data, err := loadImage(hash)
 	if err != nil {
-		fmt.Printf("Erro ao salvar arquivo: %v\n", err)
+		fmt.Printf("Erro ao ler imagem: %v\n", err)
+		sendMessage(fmt.Sprintf("IMAGE_DATA %s", parts[1]), conn)
 		return
 	}
 
-	fmt.Printf("Blockchain salva com sucesso!\n")
+	encodedData := base64.StdEncoding.EncodeToString(data)
+	sendMessage(fmt.Sprintf("IMAGE_DATA %s %s", parts[1], encodedData), conn)
 }
 
-func RequestBlockchain() {
-	leaders_lock.Lock()
-	defer leaders_lock.Unlock()
-
-	leaderConn, _, leaderExists := getAny(leaders)
+// RequestImage asks a leader for the image with the given hash and stores it
+// once its content matches the hash
+func RequestImage(ctx context.Context, hash string) error {
+	leaderConn, leaderExists := peer_manager.Any(ROLE_LEADER)
 	if !leaderExists {
-		fmt.Printf("Nenhum líder disponível para solicitar a blockchain.\n")
-		return
+		return fmt.Errorf("no leader available to request the image")
 	}
 
-	fmt.Printf("Solicitando blockchain ao líder: %s\n", leaderConn.RemoteAddr())
-	sendMessage("GET_BLOCKCHAIN", leaderConn)
+	fmt.Printf("Solicitando imagem %s ao líder: %s\n", hash, leaderConn.RemoteAddr())
+	response, err := request(ctx, leaderConn, fmt.Sprintf("GET_IMAGE %s", hash))
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Fields(response)
+	if len(parts) < 2 || parts[0] != "IMAGE_DATA" || parts[1] != hash {
+		return fmt.Errorf("unexpected response %q", firstWord(response))
+	}
+	if len(parts) < 3 {
+		return fmt.Errorf("leader does not have the image %s", hash)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(parts[2:], ""))
+	if err != nil {
+		return fmt.Errorf("invalid image data: %w", err)
+	}
+
+	// O hash recebido precisa bater com o conteudo antes de salvar
+	stored, err := storeImageIfMatches(hash, data)
+	if err != nil {
+		return fmt.Errorf("received image discarded: %w", err)
+	}
+
+	fmt.Printf("Imagem %x salva com sucesso!\n", stored)
+	return nil
 }
@@ -0,0 +1,134 @@
+package nether
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestInstallChainFileWhileReading replaces the loaded chain while other
+// goroutines keep reading it
+func TestInstallChainFileWhileReading(t *testing.T) {
+	useTestNode(t)
+	for i := 0; i < 3; i++ {
+		if err := WriteBlock(NewStorage([]Embedding{*testEmbedding(t, int64(i))}, nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	k := *NewKey()
+	downloaded := NewMemoryStore(k)
+	fillStore(t, downloaded, k, k, 8)
+	var buf bytes.Buffer
+	if err := downloaded.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := ReadBlockAt(2); err != nil {
+					t.Errorf("read during install: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := os.WriteFile(DOWNLOAD_PATH, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := installChainFile(DOWNLOAD_PATH)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if got, want := r.Metadata(), downloaded.Metadata(); got != want {
+		t.Fatalf("loaded chain %+v, want the downloaded one %+v", got, want)
+	}
+}
+
+func TestInstallChainFileKeepsChainWhenInvalid(t *testing.T) {
+	useTestNode(t)
+	if err := WriteBlock(NewStorage([]Embedding{*testEmbedding(t, 1)}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	k := *NewKey()
+	downloaded := NewMemoryStore(k)
+	fillStore(t, downloaded, k, k, 2)
+	var buf bytes.Buffer
+	if err := downloaded.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	if err := os.WriteFile(DOWNLOAD_PATH, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installChainFile(DOWNLOAD_PATH); err == nil {
+		t.Fatal("installed a corrupted chain")
+	}
+	b, err := ReadBlockAt(1)
+	if err != nil {
+		t.Fatalf("local chain unusable after a rejected download: %v", err)
+	}
+	if b.Index != 1 {
+		t.Fatalf("read block %d, want 1", b.Index)
+	}
+}
+
+// TestDownloadBlockchainInBatches downloads a chain longer than a batch from
+// a leader, which here is the node itself
+func TestDownloadBlockchainInBatches(t *testing.T) {
+	useTestNode(t)
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillStore(t, r, userdata.Key, userdata.Key, BLOCKS_BATCH+50)
+	want := r.Metadata()
+	done()
+	useLeaderPipe(t)
+
+	if err := DownloadBlockchain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+	r, done, err = loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if got := r.Metadata(); got != want {
+		t.Fatalf("downloaded chain %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(DOWNLOAD_PATH); !os.IsNotExist(err) {
+		t.Fatal("the downloaded file was left behind")
+	}
+}
@@ -1,26 +1,58 @@
 package nether
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync"
 )
 
 // Base files path
 const (
 	BLOCKCHAIN_PATH string = "data/nether.chain"
 	IMAGES_PATH     string = "data/nether.database"
-	METADATA_SIZE   int64  = int64(8 + 8 + 8 + 8 + CIPHER_SIZE)
 )
 
-// NetherReader have the reader state of the blockchain
+// Chain file header: magic, format version, metadata and a CRC of everything before it
+const (
+	CHAIN_MAGIC          string = "NTHR"
+	CHAIN_FORMAT_VERSION uint16 = 1
+	METADATA_SIZE        int64  = int64(len(CHAIN_MAGIC) + 2 + 8 + 8 + 8 + 8 + CIPHER_SIZE + 4)
+)
+
+var (
+	// ErrLegacyChain is returned when the chain file predates the versioned format
+	ErrLegacyChain = errors.New("blockchain file has no header, run migrate blockchain")
+
+	// ErrHeaderChecksum is returned when the header was not fully written
+	ErrHeaderChecksum = errors.New("blockchain header checksum mismatch")
+)
+
+// NetherReader have the reader state of the blockchain. It is safe for
+// concurrent use: blocks are read with ReadAt so readers never share a file
+// cursor, mu guards the metadata and the index, segMu guards the sealed
+// segments and appendMu allows a single writer at a time.
+//
+// Block offsets are positions in the logical chain file, the header followed
+// by every block. Sealed segments hold the start of that range and the chain
+// file holds the header and the active segment.
 type NetherReader struct {
+	path            string
 	file            *os.File
-	current         *Block
-	size            uint64
-	localSize       uint64
+	mu              sync.RWMutex
+	appendMu        sync.Mutex
+	segMu           sync.RWMutex
+	segments        []*segment
+	segmentSize     int64
+	index           *blockIndex
+	size            uint64 // height of the chain
+	localSize       uint64 // blocks stored with their storage, light nodes keep only headers
+	base            uint64 // height of the first stored block, after the genesis when bootstrapped from a checkpoint
 	lastBlockIndex  uint64
 	lastBlockOffset uint64
 	firstBlockHash  Hash
@@ -28,126 +60,358 @@ type NetherReader struct {
 
 // Close encapsula o fechamento do arquivo
 func (r *NetherReader) Close() error {
-	r.current = nil
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.index != nil {
+		r.index.Close()
+		r.index = nil
+	}
+	r.closeSegments()
 	return r.file.Close()
 }
 
-// NewReader create a new reader for the blockchain
+// NewReader create a new reader for the blockchain, repairing an interrupted append
 func NewReader() (*NetherReader, error) {
-	file, err := os.OpenFile(BLOCKCHAIN_PATH, os.O_RDWR|os.O_APPEND, 0644)
+	return openReader(BLOCKCHAIN_PATH, true)
+}
+
+// OpenReader create a new reader for the blockchain stored at path, repairing
+// an interrupted append
+func OpenReader(path string) (*NetherReader, error) {
+	return openReader(path, true)
+}
+
+// openReader create a new reader for the blockchain stored at path. Only the
+// local chain should be repaired, files received from peers are read as is.
+func openReader(path string, repair bool) (*NetherReader, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	reader := &NetherReader{
+		path:            path,
 		file:            file,
-		current:         nil,
 		size:            0,
 		localSize:       0,
 		lastBlockIndex:  0,
 		lastBlockOffset: 0,
 		firstBlockHash:  [CIPHER_SIZE]byte{},
+		segmentSize:     SEGMENT_SIZE,
+	}
+
+	if err := reader.loadSegments(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if repair {
+		if err := reader.discardSealedBlocks(); err != nil {
+			reader.Close()
+			return nil, err
+		}
 	}
 
-	reader.ReadMetadata()
-	reader.ReadGenesis()
+	err = reader.ReadMetadata()
+	if repair && (err == nil || errors.Is(err, ErrHeaderChecksum)) {
+		err = reader.recover(err)
+	}
+	if err == nil {
+		err = reader.loadBase()
+	}
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
 
 	return reader, nil
 }
 
-func (r *NetherReader) SkipMetadata() {
-	r.file.Seek(METADATA_SIZE, io.SeekStart)
-}
+// ReadMetadata loads the header. The caller must own the reader or hold mu.
+func (r *NetherReader) ReadMetadata() error {
+	header := make([]byte, METADATA_SIZE)
+	if _, err := r.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("cannot read blockchain header: %w", err)
+	}
 
-func (r *NetherReader) ReadMetadata() {
-	r.file.Seek(0, io.SeekStart)
-	binary.Read(r.file, binary.LittleEndian, &r.size)
-	binary.Read(r.file, binary.LittleEndian, &r.localSize)
-	binary.Read(r.file, binary.LittleEndian, &r.lastBlockIndex)
-	binary.Read(r.file, binary.LittleEndian, &r.lastBlockOffset)
-	binary.Read(r.file, binary.LittleEndian, r.firstBlockHash)
+	if string(header[:len(CHAIN_MAGIC)]) != CHAIN_MAGIC {
+		return ErrLegacyChain
+	}
+
+	crc := binary.LittleEndian.Uint32(header[METADATA_SIZE-4:])
+	if crc32.ChecksumIEEE(header[:METADATA_SIZE-4]) != crc {
+		return ErrHeaderChecksum
+	}
+
+	buf := bytes.NewReader(header[len(CHAIN_MAGIC):])
+	var version uint16
+	binary.Read(buf, binary.LittleEndian, &version)
+	if version != CHAIN_FORMAT_VERSION {
+		return fmt.Errorf("unsupported blockchain format version %d", version)
+	}
+
+	binary.Read(buf, binary.LittleEndian, &r.size)
+	binary.Read(buf, binary.LittleEndian, &r.localSize)
+	binary.Read(buf, binary.LittleEndian, &r.lastBlockIndex)
+	binary.Read(buf, binary.LittleEndian, &r.lastBlockOffset)
+	binary.Read(buf, binary.LittleEndian, &r.firstBlockHash)
+
+	return nil
 }
 
-func (r *NetherReader) WriteMetadata() {
-	r.file.Seek(0, io.SeekStart)
-	binary.Write(r.file, binary.LittleEndian, r.size)
-	binary.Write(r.file, binary.LittleEndian, r.localSize)
-	binary.Write(r.file, binary.LittleEndian, r.lastBlockIndex)
-	binary.Write(r.file, binary.LittleEndian, r.lastBlockOffset)
-	binary.Write(r.file, binary.LittleEndian, r.firstBlockHash)
+// WriteMetadata writes the header. The caller must own the reader or hold mu.
+func (r *NetherReader) WriteMetadata() error {
+	if _, err := r.file.WriteAt(r.metadataBytes(), 0); err != nil {
+		return fmt.Errorf("cannot write blockchain header: %w", err)
+	}
+	return nil
 }
 
-func (r *NetherReader) WriteGenesis(k Key, genesisHash Hash) {
-	r.SkipMetadata()
-	binary.Write(r.file, binary.LittleEndian, NewGenesis(k, genesisHash).Serialize())
-	r.file.Sync()
+func (r *NetherReader) metadataBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(CHAIN_MAGIC)
+	binary.Write(&buf, binary.LittleEndian, CHAIN_FORMAT_VERSION)
+	binary.Write(&buf, binary.LittleEndian, r.size)
+	binary.Write(&buf, binary.LittleEndian, r.localSize)
+	binary.Write(&buf, binary.LittleEndian, r.lastBlockIndex)
+	binary.Write(&buf, binary.LittleEndian, r.lastBlockOffset)
+	binary.Write(&buf, binary.LittleEndian, r.firstBlockHash)
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes()
 }
 
-func (r *NetherReader) ReadGenesis() {
-	r.SkipMetadata()
-	r.readBlock()
+// commitMetadata writes the header and waits for it to reach the disk. The
+// header is the commit point of an append: bytes after the last block it
+// points to are discarded by recover.
+func (r *NetherReader) commitMetadata() error {
+	if err := r.WriteMetadata(); err != nil {
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync blockchain header: %w", err)
+	}
+	return nil
 }
 
-func (r *NetherReader) ReadNext() bool {
-	if r.current.Index >= r.lastBlockIndex {
-		return false
+// loadBase finds the height of the first stored block. The caller must own the reader.
+func (r *NetherReader) loadBase() error {
+	if r.size == 0 {
+		r.base = 0
+		return nil
+	}
+	if len(r.segments) > 0 {
+		r.base = r.segments[0].FirstIndex
+		return nil
 	}
 
-	r.readBlock()
-	return true
+	first, _, err := r.readBlockAt(METADATA_SIZE)
+	if err != nil {
+		return err
+	}
+	r.base = first.Index
+	return nil
 }
 
-func (r *NetherReader) readBlock() {
-	var blockSize uint64
-	binary.Read(r.file, binary.LittleEndian, &blockSize)
+// readBlockAt decodes the block stored at offset and returns the offset of the
+// block after it. It does not touch the metadata.
+func (r *NetherReader) readBlockAt(offset int64) (*Block, int64, error) {
+	r.segMu.RLock()
+	defer r.segMu.RUnlock()
+
+	file, position, end, err := r.locate(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rawSize := make([]byte, 8)
+	if _, err := file.ReadAt(rawSize, position); err != nil {
+		return nil, 0, fmt.Errorf("cannot read block size at offset %x: %w", offset, err)
+	}
+
+	blockSize := binary.LittleEndian.Uint64(rawSize)
+	if blockSize < 8 || blockSize > uint64(end-offset) {
+		return nil, 0, fmt.Errorf("invalid block size %d at offset %x", blockSize, offset)
+	}
 
 	rawBlock := make([]byte, blockSize)
-	binary.Read(r.file, binary.LittleEndian, rawBlock[8:])
-	binary.LittleEndian.PutUint64(rawBlock[:8], blockSize)
+	if _, err := file.ReadAt(rawBlock, position); err != nil {
+		return nil, 0, fmt.Errorf("cannot read block at offset %x: %w", offset, err)
+	}
 
-	r.current = Deserialize(rawBlock)
+	b, err := deserializeBlock(rawBlock)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot decode block at offset %x: %w", offset, err)
+	}
+
+	return b, offset + int64(blockSize), nil
 }
 
+func (r *NetherReader) ReadGenesis() (*Block, error) {
+	b, _, err := r.readBlockAt(METADATA_SIZE)
+	return b, err
+}
+
+// ReadLastBlock returns the last committed block, or nil if it cannot be read
 func (r *NetherReader) ReadLastBlock() *Block {
-	r.file.Seek(int64(r.lastBlockOffset), io.SeekStart)
-	r.readBlock()
-	return r.current
+	r.mu.RLock()
+	offset := r.lastBlockOffset
+	r.mu.RUnlock()
+
+	b, _, err := r.readBlockAt(int64(offset))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// WriteBlock appends b, which must follow the last block of the chain
+func (r *NetherReader) WriteBlock(b *Block) error {
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+
+	return r.writeBlock(b)
+}
+
+// Append builds a block on top of the last one and writes it while holding
+// the append lock, so concurrent writers never fork the chain
+func (r *NetherReader) Append(build func(last *Block) (*Block, error)) (*Block, error) {
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+
+	last := r.ReadLastBlock()
+	if last == nil {
+		return nil, fmt.Errorf("cannot read the last block")
+	}
+
+	b, err := build(last)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, r.writeBlock(b)
 }
 
-func (r *NetherReader) WriteBlock(b *Block) {
-	offset, _ := r.file.Seek(0, io.SeekEnd)
-	if err := binary.Write(r.file, binary.LittleEndian, b.Serialize()); err != nil {
-		panic(err)
+// writeBlock appends b. The caller must hold appendMu.
+func (r *NetherReader) writeBlock(b *Block) error {
+	r.mu.Lock()
+	// The index is only a cache of the chain, a failure here is fixed by the next rebuild
+	indexErr := r.openIndex()
+	offset, err := r.committedEnd()
+	size := r.size
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Segments only rotate under appendMu, so the active segment cannot move
+	r.segMu.RLock()
+	activeStart := r.activeStart()
+	r.segMu.RUnlock()
+
+	if size > 0 {
+		last := r.ReadLastBlock()
+		if last == nil || b.Index != last.Index+1 || b.PrevHash != last.Hash {
+			return fmt.Errorf("block %d does not follow the last block of the chain", b.Index)
+		}
+	}
+
+	// Write the block after the last committed one and sync it before the
+	// header. Readers stop at the committed header, so no lock is needed here.
+	raw := b.Serialize()
+	if _, err := r.file.WriteAt(raw, METADATA_SIZE+offset-activeStart); err != nil {
+		return fmt.Errorf("cannot write block %d: %w", b.Index, err)
 	}
-	r.current = b
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync block %d: %w", b.Index, err)
+	}
+
+	r.mu.Lock()
+
 	r.size++
-	r.localSize++
+	if !b.HeaderOnly {
+		r.localSize++
+	}
 	r.lastBlockIndex = b.Index
 	r.lastBlockOffset = uint64(offset)
-	r.WriteMetadata()
-	r.ReadLastBlock()
+	if err := r.commitMetadata(); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+
+	if indexErr == nil {
+		indexErr = r.index.append(uint64(offset), b.Hash)
+	}
+	if indexErr != nil && r.index != nil {
+		r.index.Close()
+		r.index = nil
+	}
+	r.mu.Unlock()
+
+	// The block is committed, a failed rotation is retried on the next append
+	if r.segmentSize > 0 && offset+int64(len(raw))-activeStart >= r.segmentSize {
+		if err := r.rotate(); err != nil {
+			fmt.Printf("Erro ao rotacionar segmento: %v\n", err)
+		}
+	}
+
+	return nil
 }
 
 func newBlockchain(k Key) (*NetherReader, error) {
-	file, err := os.OpenFile(BLOCKCHAIN_PATH, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("cannot create a new blockchain: %w", err)
-	}
+	return CreateBlockchain(BLOCKCHAIN_PATH, k)
+}
 
+// CreateBlockchain writes a new chain with a genesis signed by k at path,
+// replacing any chain already there
+func CreateBlockchain(path string, k Key) (*NetherReader, error) {
 	var genesisHash Hash
 	io.ReadFull(rand.Reader, genesisHash[:])
 
+	return createChainFile(path, NewGenesis(k, genesisHash))
+}
+
+// createChainFile writes a chain whose first stored block is first. It is the
+// genesis of a new chain, or the checkpoint block of a bootstrapped one.
+func createChainFile(path string, first *Block) (*NetherReader, error) {
+	if err := removeSegments(path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a new blockchain: %w", err)
+	}
+
 	r := &NetherReader{
+		path:            path,
 		file:            file,
-		current:         nil,
-		size:            1,
-		localSize:       1,
+		size:            first.Index + 1,
+		base:            first.Index,
+		lastBlockIndex:  first.Index,
 		lastBlockOffset: uint64(METADATA_SIZE),
-		firstBlockHash:  genesisHash,
+		firstBlockHash:  first.PrevHash,
+		segmentSize:     SEGMENT_SIZE,
+	}
+
+	if !first.HeaderOnly {
+		r.localSize = 1
 	}
 
-	r.WriteMetadata()
-	r.WriteGenesis(k, genesisHash)
+	_, err = file.WriteAt(first.Serialize(), METADATA_SIZE)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot write block %d: %w", first.Index, err)
+	}
+	if err := r.commitMetadata(); err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	return r, nil
 }
@@ -0,0 +1,142 @@
+package nether
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentAppendAndReads(t *testing.T) {
+	r, k := newTestChain(t, 1)
+	defer r.Close()
+
+	const writers, blocksPerWriter = 4, 10
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < blocksPerWriter; i++ {
+				e := testEmbedding(t, int64(w*100+i))
+				_, err := r.Append(func(last *Block) (*Block, error) {
+					return NewBlock(last, k, *NewStorage([]Embedding{*e}, nil, nil))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// Every iteration sees a linked prefix of the chain
+				var prev *Block
+				it := r.Iterator()
+				for it.Next() {
+					b := it.Block()
+					if prev != nil && (b.Index != prev.Index+1 || b.PrevHash != prev.Hash) {
+						t.Errorf("iterator returned block %d after block %d", b.Index, prev.Index)
+						return
+					}
+					prev = b
+				}
+				if it.Err() != nil {
+					t.Error(it.Err())
+					return
+				}
+
+				last := r.Metadata().LastBlockIndex
+				b, err := r.ReadBlockAt(last)
+				if err != nil || b.Index != last {
+					t.Errorf("ReadBlockAt(%d) = %v, %v", last, b, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	if last := r.Metadata().LastBlockIndex; last != 1+writers*blocksPerWriter {
+		t.Fatalf("last block %d, want %d", last, 1+writers*blocksPerWriter)
+	}
+	if err := r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadWhileWriting(t *testing.T) {
+	useTestNode(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				e := testEmbedding(t, int64(i*100+j))
+				if err := WriteBlock(NewStorage([]Embedding{*e}, nil, nil)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := ReadBlockAt(0); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		LoadBlockchain()
+	}
+	wg.Wait()
+
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if last := r.Metadata().LastBlockIndex; last != 40 {
+		t.Fatalf("last block %d after reloads, want 40", last)
+	}
+}
+
+// Lookups racing to open the index of a freshly opened chain
+func TestConcurrentIndexLookups(t *testing.T) {
+	r, _ := newTestChain(t, 5)
+	r.Close()
+	r = reopenChain(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			height := uint64(i % 6)
+			b, err := r.ReadBlockAt(height)
+			if err != nil || b.Index != height {
+				t.Errorf("ReadBlockAt(%d) = %v, %v", height, b, err)
+				return
+			}
+			if _, err := r.ReadBlockByHash(b.Hash); err != nil {
+				t.Errorf("ReadBlockByHash(%x): %v", b.Hash, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,107 @@
+package nether
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// committedEnd returns the offset right after the last block the header points to
+func (r *NetherReader) committedEnd() (int64, error) {
+	if r.size == 0 {
+		return METADATA_SIZE, nil
+	}
+
+	r.segMu.RLock()
+	defer r.segMu.RUnlock()
+
+	file, position, _, err := r.locate(int64(r.lastBlockOffset))
+	if err != nil {
+		return 0, err
+	}
+
+	raw := make([]byte, 8)
+	if _, err := file.ReadAt(raw, position); err != nil {
+		return 0, fmt.Errorf("cannot read size of the last block: %w", err)
+	}
+
+	return int64(r.lastBlockOffset) + int64(binary.LittleEndian.Uint64(raw)), nil
+}
+
+// recover brings the file back to its last committed state after a crash in
+// WriteBlock. A block written without its header is truncated; a torn header
+// is rebuilt from the blocks that are still intact.
+func (r *NetherReader) recover(headerErr error) error {
+	if headerErr == nil {
+		end, err := r.committedEnd()
+		fileEnd, statErr := r.logicalEnd()
+		if err == nil && statErr == nil && end <= fileEnd {
+			if end == fileEnd {
+				return nil
+			}
+
+			fmt.Printf("Discarding %d uncommitted bytes at the end of the blockchain\n", fileEnd-end)
+			return r.truncateAt(end)
+		}
+	}
+
+	fmt.Printf("Blockchain header is inconsistent, rebuilding it from the blocks\n")
+	return r.rebuildMetadata()
+}
+
+// rebuildMetadata scans the blocks after the header, keeps the longest linked
+// prefix, truncates the rest and commits a new header
+func (r *NetherReader) rebuildMetadata() error {
+	var count uint64
+	var base uint64
+	var last *Block
+	var firstBlockHash Hash
+	var lastOffset int64
+
+	offset := METADATA_SIZE
+	for {
+		b, next, err := r.readBlockAt(offset)
+		if err != nil {
+			break
+		}
+
+		// Chains bootstrapped from a checkpoint start after the genesis
+		expectedIndex, expectedPrev := b.Index, b.PrevHash
+		if last != nil {
+			expectedIndex, expectedPrev = last.Index+1, last.Hash
+		}
+		if verifyBlock(b, expectedIndex, expectedPrev) != "" {
+			break
+		}
+
+		if last == nil {
+			base, firstBlockHash = b.Index, b.PrevHash
+		}
+		if !b.HeaderOnly {
+			count++
+		}
+		last = b
+		lastOffset = offset
+
+		offset = next
+	}
+
+	if last == nil {
+		return fmt.Errorf("blockchain has no intact block to recover")
+	}
+
+	if err := r.truncateAt(offset); err != nil {
+		return err
+	}
+
+	r.size = last.Index + 1
+	r.localSize = count
+	r.base = base
+	r.lastBlockIndex = last.Index
+	r.lastBlockOffset = uint64(lastOffset)
+	r.firstBlockHash = firstBlockHash
+	if err := r.commitMetadata(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package nether
+
+import (
+	"os"
+	"testing"
+)
+
+func appendTestBlocks(t *testing.T, r *NetherReader, k Key, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		e := testEmbedding(t, int64(i))
+		_, err := r.Append(func(last *Block) (*Block, error) {
+			return NewBlock(last, k, *NewStorage([]Embedding{*e}, nil, nil))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestChain(t *testing.T, blocks int) (*NetherReader, Key) {
+	t.Helper()
+	useTempDir(t)
+
+	k := *NewKey()
+	r, err := CreateBlockchain(BLOCKCHAIN_PATH, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestBlocks(t, r, k, blocks)
+	return r, k
+}
+
+func reopenChain(t *testing.T) *NetherReader {
+	t.Helper()
+
+	r, err := NewReader()
+	if err != nil {
+		t.Fatalf("cannot reopen the chain: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	if err := r.Verify(); err != nil {
+		t.Fatalf("recovered chain is invalid: %v", err)
+	}
+	return r
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// A crash after the block was written but before the header pointed to it
+func TestRecoverBlockWithoutHeaderCommit(t *testing.T) {
+	r, k := newTestChain(t, 3)
+	committed := fileSize(t, BLOCKCHAIN_PATH)
+
+	last := r.ReadLastBlock()
+	b, err := NewBlock(last, k, *NewStorage([]Embedding{*testEmbedding(t, 9)}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := b.Serialize()
+	r.file.WriteAt(raw[:len(raw)/2], committed)
+	r.Close()
+
+	r = reopenChain(t)
+	if size := fileSize(t, BLOCKCHAIN_PATH); size != committed {
+		t.Errorf("chain file has %d bytes after recovery, want %d", size, committed)
+	}
+	if last := r.Metadata().LastBlockIndex; last != 3 {
+		t.Errorf("last block %d after recovery, want 3", last)
+	}
+
+	appendTestBlocks(t, r, k, 1)
+	if last := r.Metadata().LastBlockIndex; last != 4 {
+		t.Errorf("last block %d after appending to the recovered chain, want 4", last)
+	}
+}
+
+// A crash in the middle of the header write
+func TestRecoverTornHeader(t *testing.T) {
+	r, _ := newTestChain(t, 3)
+	metadata := r.Metadata()
+	r.Close()
+
+	file, err := os.OpenFile(BLOCKCHAIN_PATH, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Size and last block offset from a newer header, checksum from the old one
+	file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(len(CHAIN_MAGIC)+2))
+	file.Close()
+
+	torn, err := openReader(BLOCKCHAIN_PATH, false)
+	if err != ErrHeaderChecksum {
+		if torn != nil {
+			torn.Close()
+		}
+		t.Fatalf("torn header opened with %v, want ErrHeaderChecksum", err)
+	}
+
+	r = reopenChain(t)
+	if got := r.Metadata(); got != metadata {
+		t.Errorf("rebuilt metadata %+v, want %+v", got, metadata)
+	}
+}
+
+// A crash after the manifest listed a new segment but before the chain file
+// dropped the blocks copied to it
+func TestRecoverInterruptedRotation(t *testing.T) {
+	r, k := newTestChain(t, 4)
+	metadata := r.Metadata()
+
+	beforeRotation, err := os.ReadFile(BLOCKCHAIN_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.appendMu.Lock()
+	err = r.rotate()
+	r.appendMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	if err := os.WriteFile(BLOCKCHAIN_PATH, beforeRotation, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r = reopenChain(t)
+	if size := fileSize(t, BLOCKCHAIN_PATH); size != METADATA_SIZE {
+		t.Errorf("chain file kept %d bytes of sealed blocks", size-METADATA_SIZE)
+	}
+	if got := r.Metadata(); got != metadata {
+		t.Errorf("metadata %+v after recovery, want %+v", got, metadata)
+	}
+
+	appendTestBlocks(t, r, k, 1)
+	for height := uint64(0); height <= 5; height++ {
+		if _, err := r.ReadBlockAt(height); err != nil {
+			t.Errorf("block %d: %v", height, err)
+		}
+	}
+}
+
+// A rebuilt header that cannot be written must fail the recovery instead of
+// leaving the torn one in place
+func TestRecoverHeaderCommitFails(t *testing.T) {
+	r, _ := newTestChain(t, 3)
+	r.Close()
+
+	// WriteAt fails on files opened for appending, while Truncate still works
+	file, err := os.OpenFile(BLOCKCHAIN_PATH, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &NetherReader{path: BLOCKCHAIN_PATH, file: file, segmentSize: SEGMENT_SIZE}
+	defer r.Close()
+
+	if err := r.recover(ErrHeaderChecksum); err == nil {
+		t.Fatal("recovery succeeded without committing the rebuilt header")
+	}
+}
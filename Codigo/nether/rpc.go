@@ -0,0 +1,105 @@
+package nether
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests carry an ID that the peer copies into its response, so the reply
+// reaches the caller waiting for it instead of the handlers:
+//
+//	request/response payload: id uint64 | message
+const (
+	RPC_TIMEOUT time.Duration = 30 * time.Second
+)
+
+type rpcKey struct {
+	conn net.Conn
+	id   uint64
+}
+
+var (
+	rpc_next_id atomic.Uint64
+	rpc_pending = make(map[rpcKey]chan string)
+	rpc_lock    sync.Mutex
+)
+
+// replyConn is handed to the handler of a request: what the handler sends
+// through it goes back as the response to that request
+type replyConn struct {
+	net.Conn
+	id uint64
+}
+
+func rpcPayload(id uint64, message string) []byte {
+	payload := make([]byte, 8, 8+len(message))
+	binary.LittleEndian.PutUint64(payload, id)
+	return append(payload, message...)
+}
+
+func parseRPCPayload(payload []byte) (uint64, string, error) {
+	if len(payload) < 8 {
+		return 0, "", fmt.Errorf("rpc frame without id")
+	}
+	return binary.LittleEndian.Uint64(payload), string(payload[8:]), nil
+}
+
+// request sends message to the peer and waits for its response until ctx is
+// done. The connection must be read by startChat.
+func request(ctx context.Context, conn net.Conn, message string) (string, error) {
+	key := rpcKey{conn: conn, id: rpc_next_id.Add(1)}
+	response := make(chan string, 1)
+	addToMap(rpc_pending, &rpc_lock, key, response)
+	defer deleteFromMap(rpc_pending, &rpc_lock, key)
+
+	if err := writeFrame(conn, FRAME_REQUEST, rpcPayload(key.id, message)); err != nil {
+		return "", fmt.Errorf("erro ao enviar requisição: %w", err)
+	}
+
+	select {
+	case reply, ok := <-response:
+		if !ok {
+			return "", fmt.Errorf("connection to %s closed before the response to %q: %w", conn.RemoteAddr(), firstWord(message), net.ErrClosed)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("no response to %q from %s: %w", firstWord(message), conn.RemoteAddr(), ctx.Err())
+	}
+}
+
+// deliverResponse hands a response to the request waiting for it; late
+// responses, after the caller gave up, are dropped
+func deliverResponse(conn net.Conn, id uint64, message string) {
+	rpc_lock.Lock()
+	defer rpc_lock.Unlock()
+
+	response, exists := rpc_pending[rpcKey{conn: conn, id: id}]
+	if !exists {
+		fmt.Printf("Resposta %d de %s sem requisição pendente, descartando\n", id, conn.RemoteAddr())
+		return
+	}
+
+	select {
+	case response <- message:
+	default:
+	}
+}
+
+// failPending wakes the requests still waiting on conn once it is closed, so
+// they fail right away instead of waiting for their deadline
+func failPending(conn net.Conn) {
+	rpc_lock.Lock()
+	defer rpc_lock.Unlock()
+
+	for key, response := range rpc_pending {
+		if key.conn == conn {
+			close(response)
+			delete(rpc_pending, key)
+		}
+	}
+}
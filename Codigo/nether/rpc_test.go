@@ -0,0 +1,222 @@
+package nether
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchBlocks(t *testing.T) {
+	useTestNode(t)
+	for i := 0; i < 3; i++ {
+		if err := WriteBlock(NewStorage([]Embedding{*testEmbedding(t, int64(i))}, nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := useLeaderPipe(t)
+
+	blocks, err := fetchBlocks(context.Background(), conn, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || blocks[0].Index != 1 || blocks[2].Index != 3 {
+		t.Fatalf("got %d blocks, want blocks 1 to 3", len(blocks))
+	}
+
+	blocks, err = fetchBlocks(context.Background(), conn, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("got %d blocks after the last one", len(blocks))
+	}
+}
+
+func TestRequestTimesOutWithoutResponse(t *testing.T) {
+	useTestNode(t)
+	conn := useLeaderPipe(t)
+
+	// PONG is handled without any response
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := request(ctx, conn, "PONG"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request() = %v, want a deadline error", err)
+	}
+}
+
+func TestRequestFailsWhenConnectionCloses(t *testing.T) {
+	useTestNode(t)
+	conn := useLeaderPipe(t)
+
+	result := make(chan error, 1)
+	go func() {
+		// PONG is handled without any response
+		_, err := request(context.Background(), conn, "PONG")
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("request() = %v, want a connection closed error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still waiting after its connection was closed")
+	}
+}
+
+func TestRequestMissingImage(t *testing.T) {
+	useTestNode(t)
+	useLeaderPipe(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+
+	hash := fmt.Sprintf("%x", Hash{1})
+	err := RequestImage(ctx, hash)
+	if err == nil || !strings.Contains(err.Error(), "does not have the image") {
+		t.Fatalf("RequestImage() = %v, want the leader to answer it has no image", err)
+	}
+}
+
+func TestRequestPayloadWithMalformedHash(t *testing.T) {
+	useTestNode(t)
+	conn := useLeaderPipe(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+
+	response, err := request(ctx, conn, "GET_PAYLOAD xyz")
+	if err != nil {
+		t.Fatalf("request() = %v, want an empty payload", err)
+	}
+	if response != "PAYLOAD_DATA xyz" {
+		t.Fatalf("response %q, want an empty payload", response)
+	}
+}
+
+// TestUnsolicitedBlocksAreDropped sends blocks that were not requested
+func TestUnsolicitedBlocksAreDropped(t *testing.T) {
+	useTestNode(t)
+	conn := useLeaderPipe(t)
+
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := r.ReadBlockAt(0)
+	done()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBlock(genesis, userdata.Key, *NewStorage([]Embedding{*testEmbedding(t, 1)}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dealWithRequisition(fmt.Sprintf("BLOCKS_DATA 1 %s", encodeBlocks([]*Block{b})), conn)
+
+	if _, err := ReadBlockAt(1); err == nil {
+		t.Fatal("an unsolicited block was appended to the chain")
+	}
+}
+
+// TestGetBlocksBoundedBatch fills the chain with blocks big enough that a
+// whole batch would not fit in a frame
+func TestGetBlocksBoundedBatch(t *testing.T) {
+	useTestNode(t)
+	embeddings := make([]Embedding, BATCH_MAX_FACES)
+	for i := range embeddings {
+		embeddings[i] = *testEmbedding(t, int64(i))
+	}
+
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendBig := func() int {
+		b, err := r.Append(func(last *Block) (*Block, error) {
+			return NewBlock(last, userdata.Key, *NewStorage(embeddings, nil, nil))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(b.Serialize())
+	}
+	blockSize := appendBig()
+	if blockSize*BLOCKS_BATCH <= BLOCKS_BATCH_BYTES {
+		t.Fatalf("blocks of %d bytes fit in a batch, the test needs bigger ones", blockSize)
+	}
+	for i := 0; i < BLOCKS_BATCH_BYTES/blockSize+10; i++ {
+		appendBig()
+	}
+	last := r.Metadata().LastBlockIndex
+	done()
+	conn := useLeaderPipe(t)
+
+	blocks, err := fetchBlocks(context.Background(), conn, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, b := range blocks {
+		size += len(b.Serialize())
+	}
+	if size > BLOCKS_BATCH_BYTES || len(blocks) >= BLOCKS_BATCH {
+		t.Fatalf("batch of %d blocks and %d bytes exceeds the limits", len(blocks), size)
+	}
+
+	var streamed uint64
+	err = streamBlocks(context.Background(), conn, 1, false, func(b *Block) bool {
+		streamed++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed != last {
+		t.Fatalf("streamed %d blocks, want %d", streamed, last)
+	}
+}
+
+func TestRequestHistory(t *testing.T) {
+	useTestNode(t)
+	r, done, err := loadedChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillStore(t, r, userdata.Key, userdata.Key, 12)
+	trusted, err := checkpointAt(r, 10, nil)
+	done()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := useLeaderPipe(t)
+
+	checkpoint_lock.Lock()
+	checkpoint = trusted
+	checkpoint_lock.Unlock()
+	t.Cleanup(func() { checkpoint, history_verified = nil, false })
+
+	if err := requestHistory(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(CheckpointStatus(), "History Verified: true") {
+		t.Fatal("history not marked as verified")
+	}
+
+	// A checkpoint the history does not lead to
+	checkpoint_lock.Lock()
+	checkpoint = &Checkpoint{Height: 10, BlockHash: trusted.BlockHash}
+	checkpoint_lock.Unlock()
+	if err := requestHistory(context.Background(), conn); err == nil {
+		t.Fatal("verified the history against a checkpoint with another state")
+	}
+}
@@ -0,0 +1,349 @@
+package nether
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Segment files hold consecutive blocks of the chain, without a header, and
+// are listed in a manifest next to the chain file. The active segment is
+// sealed into a new file once it reaches SEGMENT_SIZE.
+const (
+	SEGMENT_SIZE     int64  = 256 << 20
+	MANIFEST_SUFFIX  string = ".manifest"
+	MANIFEST_VERSION int    = 1
+)
+
+type segment struct {
+	File        string `json:"file"`
+	FirstIndex  uint64 `json:"first_index"`
+	LastIndex   uint64 `json:"last_index"`
+	StartOffset int64  `json:"start_offset"`
+	EndOffset   int64  `json:"end_offset"`
+	Checksum    string `json:"sha256"`
+
+	file *os.File // nil when the segment was moved to cold storage
+}
+
+type manifest struct {
+	Version  int        `json:"version"`
+	Segments []*segment `json:"segments"`
+}
+
+func readManifest(path string) ([]*segment, error) {
+	data, err := os.ReadFile(path + MANIFEST_SUFFIX)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read segment manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot decode segment manifest: %w", err)
+	}
+	if m.Version != MANIFEST_VERSION {
+		return nil, fmt.Errorf("unsupported segment manifest version %d", m.Version)
+	}
+
+	start := METADATA_SIZE
+	for _, s := range m.Segments {
+		if s.StartOffset != start || s.EndOffset <= s.StartOffset {
+			return nil, fmt.Errorf("segment %s does not follow the previous one", s.File)
+		}
+		start = s.EndOffset
+	}
+
+	return m.Segments, nil
+}
+
+// writeManifest replaces the manifest atomically, it is the commit point of a rotation
+func writeManifest(path string, segments []*segment) error {
+	data, err := json.MarshalIndent(manifest{Version: MANIFEST_VERSION, Segments: segments}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + MANIFEST_SUFFIX + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write segment manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write segment manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot sync segment manifest: %w", err)
+	}
+	file.Close()
+
+	return os.Rename(tmpPath, path+MANIFEST_SUFFIX)
+}
+
+// removeSegments deletes the manifest of the chain at path and every segment it lists
+func removeSegments(path string) error {
+	segments, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		os.Remove(filepath.Join(filepath.Dir(path), s.File))
+	}
+
+	if err := os.Remove(path + MANIFEST_SUFFIX); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove segment manifest: %w", err)
+	}
+	return nil
+}
+
+func (r *NetherReader) segmentPath(s *segment) string {
+	return filepath.Join(filepath.Dir(r.path), s.File)
+}
+
+// loadSegments reads the manifest and opens the segments still on disk
+func (r *NetherReader) loadSegments() error {
+	segments, err := readManifest(r.path)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.file, err = os.Open(r.segmentPath(s)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot open segment %s: %w", s.File, err)
+		}
+	}
+
+	r.segments = segments
+	return nil
+}
+
+func (r *NetherReader) closeSegments() {
+	for _, s := range r.segments {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+	}
+}
+
+// activeStart returns the offset of the first block stored in the chain file.
+// The caller must hold segMu.
+func (r *NetherReader) activeStart() int64 {
+	if len(r.segments) == 0 {
+		return METADATA_SIZE
+	}
+	return r.segments[len(r.segments)-1].EndOffset
+}
+
+// locate returns the file holding offset, the position of offset in it and
+// the offset where that file ends. The caller must hold segMu.
+func (r *NetherReader) locate(offset int64) (*os.File, int64, int64, error) {
+	start := r.activeStart()
+	if offset >= start {
+		info, err := r.file.Stat()
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("cannot stat blockchain file: %w", err)
+		}
+		return r.file, METADATA_SIZE + offset - start, start + info.Size() - METADATA_SIZE, nil
+	}
+
+	i := sort.Search(len(r.segments), func(i int) bool { return r.segments[i].EndOffset > offset })
+	if i == len(r.segments) || offset < r.segments[i].StartOffset {
+		return nil, 0, 0, fmt.Errorf("offset %x is outside the blockchain", offset)
+	}
+
+	s := r.segments[i]
+	if s.file == nil {
+		return nil, 0, 0, fmt.Errorf("segment %s is not available, restore it from the archive", s.File)
+	}
+	return s.file, offset - s.StartOffset, s.EndOffset, nil
+}
+
+// logicalEnd returns the offset right after the last byte of the chain file.
+// The caller must hold segMu.
+func (r *NetherReader) logicalEnd() (int64, error) {
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("cannot stat blockchain file: %w", err)
+	}
+	return r.activeStart() + info.Size() - METADATA_SIZE, nil
+}
+
+// truncateAt discards the active segment from offset onwards. The caller must
+// own the reader.
+func (r *NetherReader) truncateAt(offset int64) error {
+	start := r.activeStart()
+	if offset < start {
+		return fmt.Errorf("cannot truncate offset %x inside the sealed segment ending at %x", offset, start)
+	}
+
+	if err := r.file.Truncate(METADATA_SIZE + offset - start); err != nil {
+		return fmt.Errorf("cannot truncate torn block: %w", err)
+	}
+	return r.file.Sync()
+}
+
+// discardSealedBlocks finishes a rotation interrupted after its manifest was
+// written: the chain file still holds blocks that already live in the last segment
+func (r *NetherReader) discardSealedBlocks() error {
+	if len(r.segments) == 0 {
+		return nil
+	}
+
+	raw := make([]byte, 8+1+8)
+	if _, err := r.file.ReadAt(raw, METADATA_SIZE); err != nil {
+		return nil
+	}
+
+	index := binary.LittleEndian.Uint64(raw[9:])
+	if index > r.segments[len(r.segments)-1].LastIndex {
+		return nil
+	}
+
+	fmt.Printf("Discarding blocks already sealed in segment %s\n", r.segments[len(r.segments)-1].File)
+	if err := r.file.Truncate(METADATA_SIZE); err != nil {
+		return fmt.Errorf("cannot discard sealed blocks: %w", err)
+	}
+	return r.file.Sync()
+}
+
+// rotate seals the active segment: its blocks are copied to a new segment
+// file, the manifest is committed and the chain file keeps only the header.
+// The caller must hold appendMu.
+func (r *NetherReader) rotate() error {
+	r.mu.RLock()
+	end, err := r.committedEnd()
+	lastIndex := r.lastBlockIndex
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	start := r.activeStart()
+	first, _, err := r.readBlockAt(start)
+	if err != nil {
+		return err
+	}
+
+	s := &segment{
+		File:        fmt.Sprintf("%s.%06d", filepath.Base(r.path), len(r.segments)),
+		FirstIndex:  first.Index,
+		LastIndex:   lastIndex,
+		StartOffset: start,
+		EndOffset:   end,
+	}
+
+	path := r.segmentPath(s)
+	out, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create segment: %w", err)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), io.NewSectionReader(r.file, METADATA_SIZE, end-start))
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("cannot write segment %s: %w", s.File, err)
+	}
+	s.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	if s.file, err = os.Open(path); err != nil {
+		return fmt.Errorf("cannot open segment %s: %w", s.File, err)
+	}
+
+	segments := append(append([]*segment{}, r.segments...), s)
+	if err := writeManifest(r.path, segments); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	r.segMu.Lock()
+	defer r.segMu.Unlock()
+
+	r.segments = segments
+	if err := r.file.Truncate(METADATA_SIZE); err != nil {
+		return fmt.Errorf("cannot discard sealed blocks: %w", err)
+	}
+	return r.file.Sync()
+}
+
+// VerifySegments checks every sealed segment on disk against the checksum of
+// the manifest and returns the names of the ones moved to cold storage
+func (r *NetherReader) VerifySegments() ([]string, error) {
+	r.segMu.RLock()
+	defer r.segMu.RUnlock()
+
+	archived := make([]string, 0)
+	for _, s := range r.segments {
+		if s.file == nil {
+			archived = append(archived, s.File)
+			continue
+		}
+
+		hash := sha256.New()
+		n, err := io.Copy(hash, io.NewSectionReader(s.file, 0, 1<<62))
+		if err != nil {
+			return archived, fmt.Errorf("cannot read segment %s: %w", s.File, err)
+		}
+		if n != s.EndOffset-s.StartOffset {
+			return archived, fmt.Errorf("segment %s has %d bytes, expected %d", s.File, n, s.EndOffset-s.StartOffset)
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != s.Checksum {
+			return archived, fmt.Errorf("segment %s checksum mismatch", s.File)
+		}
+	}
+
+	return archived, nil
+}
+
+// Export writes the committed chain as a single unsegmented chain file
+func (r *NetherReader) Export(w io.Writer) error {
+	r.mu.RLock()
+	end, err := r.committedEnd()
+	header := r.metadataBytes()
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	r.segMu.RLock()
+	defer r.segMu.RUnlock()
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for offset := METADATA_SIZE; offset < end; {
+		file, position, fileEnd, err := r.locate(offset)
+		if err != nil {
+			return err
+		}
+
+		n := min(fileEnd, end) - offset
+		if _, err := io.Copy(w, io.NewSectionReader(file, position, n)); err != nil {
+			return fmt.Errorf("cannot export blocks at offset %x: %w", offset, err)
+		}
+		offset += n
+	}
+
+	return nil
+}
@@ -2,17 +2,35 @@ package nether
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type RequestData struct {
 	Embeddings []float64 `json:"embeddings"`
 	ImagePaths string    `json:"image_path"`
+	Image      []byte    `json:"image"`
+	Normalize  bool      `json:"normalize"`
+	CameraID   string    `json:"camera_id"`
+	SiteID     string    `json:"site_id"`
+	Direction  string    `json:"direction"`
+	Confidence float64   `json:"confidence"`
+	TrackID    string    `json:"track_id"`
+	CapturedAt int64     `json:"captured_at"` // unix milliseconds
 }
 
+// Images sent by path are only read from FACES_PATH, where the camera
+// application saves the captured faces
+const (
+	FACES_PATH string = "data/faces"
+)
+
 func InitServer() {
 	http.HandleFunc("/add", addToBlockchainHandler)
 
@@ -56,33 +74,108 @@ func addToBlockchainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validar embedding
-	if len(requestData.Embeddings) != 128 {
-		http.Error(w, "O embedding deve conter exatamente 128 floats.", http.StatusBadRequest)
+	if len(requestData.Embeddings) != EMBEDDING_DIMENSIONS {
+		http.Error(w, fmt.Sprintf("O embedding deve conter exatamente %d floats.", EMBEDDING_DIMENSIONS), http.StatusBadRequest)
 		return
 	}
 
-	var embeddingData [128]float64
+	var embeddingData [EMBEDDING_DIMENSIONS]float64
 	copy(embeddingData[:], requestData.Embeddings)
 
-	embedding, err := newEmbedding(embeddingData)
+	embedding, err := newEmbedding(embeddingData, requestData.Normalize)
 	if err != nil {
-		http.Error(w, "Erro ao criar embedding: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Embedding inválido: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Validar caminho da imagem
-	if _, err := os.Stat(requestData.ImagePaths); os.IsNotExist(err) {
-		http.Error(w, fmt.Sprintf("O arquivo de imagem não existe no caminho especificado: %s", requestData.ImagePaths), http.StatusBadRequest)
+	// Obter os bytes da imagem, enviados no corpo ou lidos da pasta de rostos
+	imageData := requestData.Image
+	if len(imageData) == 0 {
+		imageData, err = readFaceImage(requestData.ImagePaths)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Não foi possível ler a imagem no caminho especificado: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Salvar a imagem no banco de imagens
+	image, err := newImage(imageData)
+	if err != nil {
+		http.Error(w, "Erro ao salvar imagem: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	image := Image{data: requestData.ImagePaths}
+	// Montar o evento da captura
+	direction, err := ParseDirection(requestData.Direction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Adicionar ao blockchain
-	WriteBlock(NewStorage(*embedding, image))
+	capturedAt := requestData.CapturedAt
+	if capturedAt <= 0 {
+		capturedAt = time.Now().UnixMilli()
+	}
+
+	event := FaceEvent{
+		CameraID:    requestData.CameraID,
+		SiteID:      requestData.SiteID,
+		Direction:   direction,
+		Confidence:  requestData.Confidence,
+		TrackID:     requestData.TrackID,
+		CapturedAt:  uint64(capturedAt),
+		EmbeddingID: embedding.ID(),
+		ImageHash:   image.hash,
+	}
+	if err := event.Validate(); err != nil {
+		http.Error(w, "Evento inválido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Adicionar ao blockchain, junto com os rostos recebidos na mesma janela
+	if err := submitFace(*embedding, *image, event); err != nil {
+		fmt.Printf("Erro ao escrever bloco: %v\n", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrChainNotLoaded) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "Erro ao adicionar ao blockchain: "+err.Error(), status)
+		return
+	}
 	fmt.Printf("Novo rosto adicionado a blockchain\n")
 
 	// Responder ao cliente
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Dados adicionados ao blockchain com sucesso."))
 }
+
+// readFaceImage reads an image saved by the camera application. The path must
+// resolve, after following symlinks, to a file inside FACES_PATH.
+func readFaceImage(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("envie a imagem ou o caminho de uma imagem em %s", FACES_PATH)
+	}
+
+	root, err := filepath.Abs(FACES_PATH)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pasta de rostos indisponível: %w", err)
+	}
+
+	resolved, err := filepath.Abs(filepath.Clean(path))
+	if err == nil {
+		resolved, err = filepath.EvalSymlinks(resolved)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imagem %s não encontrada", path)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("imagem %s fora de %s", path, FACES_PATH)
+	}
+
+	return os.ReadFile(resolved)
+}
@@ -0,0 +1,64 @@
+package nether
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFaceImage(t *testing.T) {
+	useTempDir(t)
+
+	if err := os.MkdirAll(FACES_PATH, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(FACES_PATH, "1.jpg"), []byte("face"), 0644)
+	os.WriteFile(USERDATA_PATH, []byte("keystore"), 0600)
+	os.Symlink(filepath.Join("..", "nether.conf"), filepath.Join(FACES_PATH, "link.jpg"))
+	abs, _ := filepath.Abs(filepath.Join(FACES_PATH, "1.jpg"))
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{filepath.Join(FACES_PATH, "1.jpg"), true},
+		{abs, true},
+		{USERDATA_PATH, false},
+		{filepath.Join(FACES_PATH, "..", "nether.conf"), false},
+		{filepath.Join(FACES_PATH, "link.jpg"), false},
+		{FACES_PATH, false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		data, err := readFaceImage(tt.path)
+		if tt.ok && (err != nil || string(data) != "face") {
+			t.Errorf("readFaceImage(%q) = %q, %v, want the face", tt.path, data, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("readFaceImage(%q) read %q, want an error", tt.path, data)
+		}
+	}
+}
+
+func TestAddRejectsPathOutsideFaces(t *testing.T) {
+	useTestNode(t)
+	os.WriteFile(USERDATA_PATH, []byte("keystore"), 0600)
+
+	vector := testVector(1)
+	body, _ := json.Marshal(RequestData{Embeddings: vector[:], ImagePaths: USERDATA_PATH})
+
+	w := httptest.NewRecorder()
+	addToBlockchainHandler(w, httptest.NewRequest(http.MethodPost, "/add", bytes.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if last := reader.Metadata().LastBlockIndex; last != 0 {
+		t.Fatalf("a block was written for a rejected image")
+	}
+}
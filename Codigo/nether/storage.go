@@ -2,59 +2,170 @@ package nether
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 )
 
 type Storage struct {
-	Embedding Embedding
-	Image     Image
+	Embeddings []Embedding
+	Images     []Image
+	Events     []FaceEvent
 }
 
-func (s *Storage) Serialize() []byte {
+// Serialize encodes the storage with the layout of the given block version
+func (s *Storage) Serialize(version uint8) []byte {
 	buffer := new(bytes.Buffer)
 
-	serializedEmbedding, err := s.Embedding.Serialize()
-	if err != nil {
-		fmt.Printf("erro ao serializar embedding: %v", err)
-		return nil
+	binary.Write(buffer, binary.LittleEndian, uint32(len(s.Embeddings)))
+	for i := range s.Embeddings {
+		serializedEmbedding, err := s.Embeddings[i].serializeFor(version)
+		if err != nil {
+			fmt.Printf("erro ao serializar embedding %d: %v", i, err)
+			return nil
+		}
+		buffer.Write(serializedEmbedding)
 	}
-	buffer.Write(serializedEmbedding)
 
-	serializedImage, err := s.Image.Serialize()
-	if err != nil {
-		fmt.Printf("erro ao serializar imagem: %v", err)
-		return nil
+	binary.Write(buffer, binary.LittleEndian, uint32(len(s.Images)))
+	for i := range s.Images {
+		serializedImage, err := s.Images[i].serializeFor(version)
+		if err != nil {
+			fmt.Printf("erro ao serializar imagem %d: %v", i, err)
+			return nil
+		}
+		buffer.Write(serializedImage)
+	}
+
+	if version < BLOCK_VERSION_FACE_EVENT {
+		return buffer.Bytes()
+	}
+
+	binary.Write(buffer, binary.LittleEndian, uint32(len(s.Events)))
+	for i := range s.Events {
+		serializedEvent, err := s.Events[i].Serialize()
+		if err != nil {
+			fmt.Printf("erro ao serializar evento %d: %v", i, err)
+			return nil
+		}
+		buffer.Write(serializedEvent)
 	}
-	buffer.Write(serializedImage)
 
 	return buffer.Bytes()
 }
 
-func (s *Storage) Deserialize(data []byte) error {
+func (s *Storage) Deserialize(data []byte, version uint8) error {
 	buffer := bytes.NewReader(data)
 
-	embeddingData := make([]byte, EMBEDDING_SIZE)
-	if _, err := buffer.Read(embeddingData); err != nil {
-		return fmt.Errorf("erro ao ler dados do embedding: %v", err)
+	var numEmbeddings uint32
+	if err := binary.Read(buffer, binary.LittleEndian, &numEmbeddings); err != nil {
+		return fmt.Errorf("erro ao ler quantidade de embeddings: %v", err)
+	}
+	embeddingSize := embeddingSizeFor(version)
+	if uint64(numEmbeddings)*uint64(embeddingSize) > uint64(buffer.Len()) {
+		return fmt.Errorf("quantidade de embeddings inválida: %d", numEmbeddings)
 	}
-	if err := s.Embedding.Deserialize(embeddingData); err != nil {
-		return fmt.Errorf("erro ao desserializar embedding: %v", err)
+
+	s.Embeddings = make([]Embedding, numEmbeddings)
+	embeddingData := make([]byte, embeddingSize)
+	for i := range s.Embeddings {
+		if _, err := buffer.Read(embeddingData); err != nil {
+			return fmt.Errorf("erro ao ler dados do embedding %d: %v", i, err)
+		}
+		if err := s.Embeddings[i].deserializeFor(embeddingData, version); err != nil {
+			return fmt.Errorf("erro ao desserializar embedding %d: %v", i, err)
+		}
 	}
 
-	imageData := make([]byte, 200)
-	if _, err := buffer.Read(imageData); err != nil {
-		return fmt.Errorf("erro ao ler dados da imagem: %v", err)
+	var numImages uint32
+	if err := binary.Read(buffer, binary.LittleEndian, &numImages); err != nil {
+		return fmt.Errorf("erro ao ler quantidade de imagens: %v", err)
+	}
+	imageSize := imageSizeFor(version)
+	if uint64(numImages)*uint64(imageSize) > uint64(buffer.Len()) {
+		return fmt.Errorf("quantidade de imagens inválida: %d", numImages)
+	}
+
+	s.Images = make([]Image, numImages)
+	imageData := make([]byte, imageSize)
+	for i := range s.Images {
+		if _, err := buffer.Read(imageData); err != nil {
+			return fmt.Errorf("erro ao ler dados da imagem %d: %v", i, err)
+		}
+		if err := s.Images[i].deserializeFor(imageData, version); err != nil {
+			return fmt.Errorf("erro ao desserializar imagem %d: %v", i, err)
+		}
+	}
+
+	if version < BLOCK_VERSION_FACE_EVENT {
+		return nil
+	}
+
+	var numEvents uint32
+	if err := binary.Read(buffer, binary.LittleEndian, &numEvents); err != nil {
+		return fmt.Errorf("erro ao ler quantidade de eventos: %v", err)
+	}
+	if uint64(numEvents) > uint64(buffer.Len()) {
+		return fmt.Errorf("quantidade de eventos inválida: %d", numEvents)
 	}
-	if err := s.Image.Deserialize(imageData); err != nil {
-		return fmt.Errorf("erro ao desserializar imagem: %v", err)
+
+	s.Events = make([]FaceEvent, numEvents)
+	for i := range s.Events {
+		if err := s.Events[i].deserializeFrom(buffer); err != nil {
+			return fmt.Errorf("erro ao desserializar evento %d: %v", i, err)
+		}
 	}
 
 	return nil
 }
 
-func NewStorage(e Embedding, i Image) *Storage {
+// entries returns every embedding, image and event serialized on its own, in
+// storage order. They are the leaves of the block merkle tree.
+func (s *Storage) entries(version uint8) [][]byte {
+	entries := make([][]byte, 0, len(s.Embeddings)+len(s.Images)+len(s.Events))
+
+	for i := range s.Embeddings {
+		serializedEmbedding, _ := s.Embeddings[i].serializeFor(version)
+		entries = append(entries, serializedEmbedding)
+	}
+
+	for i := range s.Images {
+		serializedImage, _ := s.Images[i].serializeFor(version)
+		entries = append(entries, serializedImage)
+	}
+
+	if version >= BLOCK_VERSION_FACE_EVENT {
+		for i := range s.Events {
+			serializedEvent, _ := s.Events[i].Serialize()
+			entries = append(entries, serializedEvent)
+		}
+	}
+
+	return entries
+}
+
+// merkleRoot returns the merkle root over the storage entries
+func (s *Storage) merkleRoot(version uint8) Hash {
+	return merkleRoot(s.entries(version))
+}
+
+// computeSize returns the serialized size of the storage in bytes
+func (s *Storage) computeSize(version uint8) int {
+	size := 4 + len(s.Embeddings)*embeddingSizeFor(version) + 4 + len(s.Images)*imageSizeFor(version)
+
+	if version >= BLOCK_VERSION_FACE_EVENT {
+		size += 4
+		for i := range s.Events {
+			size += s.Events[i].computeSize()
+		}
+	}
+
+	return size
+}
+
+func NewStorage(embeddings []Embedding, images []Image, events []FaceEvent) *Storage {
 	return &Storage{
-		Embedding: e,
-		Image:     i,
+		Embeddings: embeddings,
+		Images:     images,
+		Events:     events,
 	}
 }
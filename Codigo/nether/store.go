@@ -0,0 +1,236 @@
+package nether
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ChainMetadata is the header information of a stored chain
+type ChainMetadata struct {
+	Size           uint64
+	LocalSize      uint64
+	LastBlockIndex uint64
+	BaseIndex      uint64 // height of the first block held by the store
+	FirstBlockHash Hash
+}
+
+// ChainStore is where a node keeps its blocks. NetherReader stores them in a
+// chain file; MemoryStore keeps them in memory for tests and simulations.
+type ChainStore interface {
+	// Append builds a block on top of the last one and stores it, holding
+	// off other writers until it returns
+	Append(build func(last *Block) (*Block, error)) (*Block, error)
+	ReadBlockAt(height uint64) (*Block, error)
+	ReadBlockByHash(hash Hash) (*Block, error)
+	// Scan calls yield for the committed blocks from height on, in order,
+	// until it returns false. Heights past the last block yield nothing and
+	// are not an error.
+	Scan(from uint64, yield func(b *Block) bool) error
+	// Export writes the committed chain as a single chain file
+	Export(w io.Writer) error
+	// Verify walks every block and returns the first inconsistency found
+	Verify() error
+	Metadata() ChainMetadata
+	Close() error
+}
+
+var (
+	_ ChainStore = (*NetherReader)(nil)
+	_ ChainStore = (*MemoryStore)(nil)
+)
+
+func (r *NetherReader) Metadata() ChainMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return ChainMetadata{
+		Size:           r.size,
+		LocalSize:      r.localSize,
+		LastBlockIndex: r.lastBlockIndex,
+		BaseIndex:      r.base,
+		FirstBlockHash: r.firstBlockHash,
+	}
+}
+
+// MemoryStore keeps serialized blocks in memory, so every read decodes a copy
+// just like a chain file does
+type MemoryStore struct {
+	mu             sync.RWMutex
+	blocks         [][]byte
+	heights        map[Hash]uint64
+	localSize      uint64
+	firstBlockHash Hash
+	closed         bool
+}
+
+// NewMemoryStore creates an in-memory chain with a genesis signed by k
+func NewMemoryStore(k Key) *MemoryStore {
+	var genesisHash Hash
+	io.ReadFull(rand.Reader, genesisHash[:])
+
+	m := &MemoryStore{
+		heights:        make(map[Hash]uint64),
+		firstBlockHash: genesisHash,
+	}
+	m.store(NewGenesis(k, genesisHash))
+	return m
+}
+
+// store keeps b after the last block. The caller must hold mu.
+func (m *MemoryStore) store(b *Block) {
+	m.heights[b.Hash] = uint64(len(m.blocks))
+	m.blocks = append(m.blocks, b.Serialize())
+	if !b.HeaderOnly {
+		m.localSize++
+	}
+}
+
+func (m *MemoryStore) Append(build func(last *Block) (*Block, error)) (*Block, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, fmt.Errorf("chain store is closed")
+	}
+
+	last, err := deserializeBlock(m.blocks[len(m.blocks)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := build(last)
+	if err != nil {
+		return nil, err
+	}
+	if b.Index != last.Index+1 || b.PrevHash != last.Hash {
+		return nil, fmt.Errorf("block %d does not follow the last block of the chain", b.Index)
+	}
+
+	m.store(b)
+	return b, nil
+}
+
+func (m *MemoryStore) ReadBlockAt(height uint64) (*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return nil, fmt.Errorf("chain store is closed")
+	}
+	if height >= uint64(len(m.blocks)) {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+
+	return deserializeBlock(m.blocks[height])
+}
+
+func (m *MemoryStore) ReadBlockByHash(hash Hash) (*Block, error) {
+	m.mu.RLock()
+	height, exists := m.heights[hash]
+	m.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return m.ReadBlockAt(height)
+}
+
+func (m *MemoryStore) Scan(from uint64, yield func(b *Block) bool) error {
+	last := m.Metadata().LastBlockIndex
+	for height := from; height <= last; height++ {
+		b, err := m.ReadBlockAt(height)
+		if err != nil {
+			return err
+		}
+		if !yield(b) {
+			break
+		}
+	}
+	return nil
+}
+
+// Export writes the blocks after a header like the one of a chain file holding them
+func (m *MemoryStore) Export(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return fmt.Errorf("chain store is closed")
+	}
+
+	header := &NetherReader{
+		size:            uint64(len(m.blocks)),
+		localSize:       m.localSize,
+		lastBlockIndex:  uint64(len(m.blocks) - 1),
+		lastBlockOffset: uint64(METADATA_SIZE),
+		firstBlockHash:  m.firstBlockHash,
+	}
+	for _, raw := range m.blocks[:len(m.blocks)-1] {
+		header.lastBlockOffset += uint64(len(raw))
+	}
+
+	if _, err := w.Write(header.metadataBytes()); err != nil {
+		return err
+	}
+	for _, raw := range m.blocks {
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Verify() error {
+	metadata := m.Metadata()
+	expectedIndex, expectedPrev := uint64(0), metadata.FirstBlockHash
+	var withStorage uint64
+	var chainErr *ChainError
+
+	err := m.Scan(0, func(b *Block) bool {
+		if reason := verifyBlock(b, expectedIndex, expectedPrev); reason != "" {
+			chainErr = &ChainError{Index: expectedIndex, Reason: reason}
+			return false
+		}
+		if !b.HeaderOnly {
+			withStorage++
+		}
+		expectedIndex, expectedPrev = b.Index+1, b.Hash
+		return true
+	})
+
+	switch {
+	case err != nil:
+		return err
+	case chainErr != nil:
+		return chainErr
+	case withStorage != metadata.LocalSize:
+		return &ChainError{Index: metadata.LastBlockIndex, Reason: fmt.Sprintf("metadata local size %d does not match %d blocks with storage", metadata.LocalSize, withStorage)}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Metadata() ChainMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	metadata := ChainMetadata{
+		Size:           uint64(len(m.blocks)),
+		LocalSize:      m.localSize,
+		FirstBlockHash: m.firstBlockHash,
+	}
+	if len(m.blocks) > 0 {
+		metadata.LastBlockIndex = uint64(len(m.blocks) - 1)
+	}
+	return metadata
+}
+
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.blocks, m.heights = nil, nil
+	return nil
+}
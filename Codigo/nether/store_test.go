@@ -0,0 +1,255 @@
+package nether
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// appendHeaderOnly appends a block of which only the header is stored, as a light node does
+func appendHeaderOnly(t *testing.T, s ChainStore, k Key) {
+	t.Helper()
+
+	e := testEmbedding(t, 99)
+	_, err := s.Append(func(last *Block) (*Block, error) {
+		b, err := NewBlock(last, k, *NewStorage([]Embedding{*e}, nil, nil))
+		if err != nil {
+			return nil, err
+		}
+		return b.Header(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreLocalSize(t *testing.T) {
+	k := *NewKey()
+	m := NewMemoryStore(k)
+	fillStore(t, m, k, k, 3)
+	appendHeaderOnly(t, m, k)
+	appendHeaderOnly(t, m, k)
+
+	metadata := m.Metadata()
+	if metadata.Size != 6 || metadata.LastBlockIndex != 5 {
+		t.Fatalf("size %d, last block %d, want 6 and 5", metadata.Size, metadata.LastBlockIndex)
+	}
+	if metadata.LocalSize != 4 {
+		t.Fatalf("local size %d, want 4 blocks with storage", metadata.LocalSize)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreVerifyFindsBrokenLink(t *testing.T) {
+	k := *NewKey()
+	m := NewMemoryStore(k)
+	fillStore(t, m, k, k, 3)
+
+	// Replace block 2 with a valid block that does not follow block 1
+	other := NewMemoryStore(k)
+	fillStore(t, other, k, k, 2)
+	forged, err := other.ReadBlockAt(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.blocks[2] = forged.Serialize()
+
+	var chainErr *ChainError
+	if err := m.Verify(); !errors.As(err, &chainErr) || chainErr.Index != 2 {
+		t.Fatalf("Verify() = %v, want a chain error at block 2", err)
+	}
+}
+
+func TestMemoryStoreReadBlockByHash(t *testing.T) {
+	k := *NewKey()
+	m := NewMemoryStore(k)
+	fillStore(t, m, k, k, 4)
+
+	want, err := m.ReadBlockAt(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.ReadBlockByHash(want.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Index != 3 || got.Hash != want.Hash {
+		t.Fatalf("got block %d, want block 3", got.Index)
+	}
+
+	if _, err := m.ReadBlockByHash(Hash{}); err == nil {
+		t.Fatal("found a block that is not in the chain")
+	}
+}
+
+// TestMemoryStoreExport opens the exported chain as a chain file
+func TestMemoryStoreExport(t *testing.T) {
+	useTempDir(t)
+
+	k := *NewKey()
+	m := NewMemoryStore(k)
+	fillStore(t, m, k, k, 5)
+	appendHeaderOnly(t, m, k)
+
+	var buf bytes.Buffer
+	if err := m.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(BLOCKCHAIN_PATH, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openReader(BLOCKCHAIN_PATH, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Metadata(), m.Metadata(); got != want {
+		t.Fatalf("exported metadata %+v, want %+v", got, want)
+	}
+	for height := uint64(0); height <= 6; height++ {
+		got, err := r.ReadBlockAt(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := m.ReadBlockAt(height)
+		if got.Hash != want.Hash {
+			t.Fatalf("block %d differs after export", height)
+		}
+	}
+}
+
+// TestCheckpointAtStores computes the same checkpoint from a chain file and
+// from a copy of it in memory
+func TestCheckpointAtStores(t *testing.T) {
+	useTempDir(t)
+
+	k := *NewKey()
+	m := NewMemoryStore(k)
+	fillStore(t, m, k, k, 6)
+
+	var buf bytes.Buffer
+	if err := m.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(BLOCKCHAIN_PATH, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openReader(BLOCKCHAIN_PATH, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	fromMemory, err := checkpointAt(m, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := checkpointAt(r, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromMemory.digest() != fromFile.digest() {
+		t.Fatal("checkpoints of the same chain differ between stores")
+	}
+
+	// Folding on from a trusted checkpoint gives the same state
+	later, err := checkpointAt(m, 6, fromMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := checkpointAt(r, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if later.digest() != full.digest() {
+		t.Fatal("checkpoint folded from a trusted one differs from the full fold")
+	}
+}
+
+func TestUseChainStore(t *testing.T) {
+	useTempDir(t)
+	userdata = &UserData{Name: "test", Key: *NewKey()}
+	t.Cleanup(func() {
+		reader.Close()
+		reader, userdata = nil, nil
+	})
+
+	NewMemoryBlockchain()
+	if err := WriteBlock(NewStorage([]Embedding{*testEmbedding(t, 1)}, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadBlockAt(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(BLOCKCHAIN_PATH); !os.IsNotExist(err) {
+		t.Fatal("the memory blockchain wrote a chain file")
+	}
+	if _, _, err := FindByEmbeddingID(b.Storage.Embeddings[0].id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifySegments(); !errors.Is(err, errNotChainFile) {
+		t.Fatalf("VerifySegments() = %v, want %v", err, errNotChainFile)
+	}
+}
+
+// TestScanStores runs the same scans against a chain file and a memory store
+func TestScanStores(t *testing.T) {
+	useTempDir(t)
+
+	k := *NewKey()
+	r, err := CreateBlockchain(BLOCKCHAIN_PATH, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	m := NewMemoryStore(k)
+
+	stores := map[string]ChainStore{"file": r, "memory": m}
+	for _, s := range stores {
+		fillStore(t, s, k, k, 4)
+	}
+
+	tests := []struct {
+		from  uint64
+		limit int
+		want  []uint64
+	}{
+		{0, 0, []uint64{0, 1, 2, 3, 4}},
+		{2, 0, []uint64{2, 3, 4}},
+		{4, 0, []uint64{4}},
+		{5, 0, nil},
+		{100, 0, nil},
+		{1, 2, []uint64{1, 2}},
+	}
+
+	for name, s := range stores {
+		for _, tt := range tests {
+			var got []uint64
+			err := s.Scan(tt.from, func(b *Block) bool {
+				got = append(got, b.Index)
+				return tt.limit == 0 || len(got) < tt.limit
+			})
+			if err != nil {
+				t.Errorf("%s: Scan(%d) = %v", name, tt.from, err)
+				continue
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s: Scan(%d) yielded %v, want %v", name, tt.from, got, tt.want)
+			}
+		}
+	}
+}
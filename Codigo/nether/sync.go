@@ -0,0 +1,734 @@
+package nether
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocks travel in batches of at most BLOCKS_BATCH blocks and
+// BLOCKS_BATCH_BYTES serialized bytes; base64 grows a batch by a third, which
+// still fits in MAX_FRAME_SIZE
+const (
+	BLOCKS_BATCH       int           = 200
+	BLOCKS_BATCH_BYTES int           = 8 << 20
+	SYNC_PATH          string        = BLOCKCHAIN_PATH + ".sync"
+	HISTORY_PATH       string        = BLOCKCHAIN_PATH + ".history"
+	HISTORY_TIMEOUT    time.Duration = 5 * time.Minute
+)
+
+var (
+	checkpoint      *Checkpoint
+	checkpoint_lock sync.Mutex
+
+	sync_lock        sync.Mutex
+	sync_active      = false
+	history_verified = false
+)
+
+// currentCheckpoint returns the latest checkpoint, loading it from disk on first
+// use. The caller must hold checkpoint_lock.
+func currentCheckpoint() *Checkpoint {
+	if checkpoint == nil {
+		var err error
+		if checkpoint, err = loadCheckpoint(); err != nil {
+			fmt.Printf("Erro ao carregar checkpoint: %v\n", err)
+		}
+	}
+	return checkpoint
+}
+
+func encodeBlocks(blocks []*Block) string {
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		buf.Write(b.Serialize())
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func decodeBlocks(encoded string) ([]*Block, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*Block, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated block %d", len(blocks))
+		}
+		size := binary.LittleEndian.Uint64(data)
+		if size < 8 || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid size %d for block %d", size, len(blocks))
+		}
+
+		b, err := deserializeBlock(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+		data = data[size:]
+	}
+
+	return blocks, nil
+}
+
+// checkpointLoop makes a leader sign a checkpoint of its chain periodically
+func checkpointLoop() {
+	ticker := time.NewTicker(CHECKPOINT_PERIOD)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !i_am_leader {
+			continue
+		}
+		if err := ProduceCheckpoint(); err != nil {
+			fmt.Printf("Erro ao gerar checkpoint: %v\n", err)
+		}
+	}
+}
+
+// ProduceCheckpoint signs a checkpoint at the last multiple of
+// CHECKPOINT_INTERVAL of the local chain and shares it with the other leaders
+func ProduceCheckpoint() error {
+	r, done, err := loadedChain()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	height := r.Metadata().LastBlockIndex / CHECKPOINT_INTERVAL * CHECKPOINT_INTERVAL
+
+	checkpoint_lock.Lock()
+	current := currentCheckpoint()
+	if current != nil && current.Height >= height {
+		checkpoint_lock.Unlock()
+		return nil
+	}
+
+	c, err := checkpointAt(r, height, current)
+	if err == nil {
+		err = c.sign(userdata.Key)
+	}
+	if err == nil {
+		err = saveCheckpoint(c)
+	}
+	if err == nil {
+		checkpoint = c
+	}
+	checkpoint_lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checkpoint do bloco %d assinado, enviando aos lideres\n", c.Height)
+	broadcastLeaders(fmt.Sprintf("CHECKPOINT %s", base64.StdEncoding.EncodeToString(c.Serialize())))
+	return nil
+}
+
+// handleCheckpoint collects the signatures of the other leaders. A checkpoint
+// is only signed after checking it against the local chain.
+func handleCheckpoint(conn net.Conn, parts []string) {
+	if !i_am_leader || len(parts) < 2 {
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		fmt.Printf("Checkpoint recebido em formato inválido: %v\n", err)
+		return
+	}
+	received, err := deserializeCheckpoint(data)
+	if err != nil {
+		fmt.Printf("Checkpoint recebido em formato inválido: %v\n", err)
+		return
+	}
+
+	// The chain is locked before the checkpoint, as in ProduceCheckpoint
+	r, done, err := loadedChain()
+	if err != nil {
+		return
+	}
+	defer done()
+
+	// Without trusted leaders only the own signature is kept
+	trusted, err := trustedLeaders()
+	if err != nil {
+		fmt.Printf("Assinaturas de outros líderes ignoradas: %v\n", err)
+	}
+
+	checkpoint_lock.Lock()
+	current := currentCheckpoint()
+	changed := false
+
+	switch {
+	case current != nil && received.Height < current.Height:
+	case current != nil && received.digest() == current.digest():
+		changed = current.merge(received, trusted)
+	default:
+		own, err := checkpointAt(r, received.Height, current)
+		if err != nil || own.digest() != received.digest() {
+			fmt.Printf("Checkpoint do bloco %d não confere com a blockchain local, ignorando\n", received.Height)
+			break
+		}
+		own.merge(received, trusted)
+		if err := own.sign(userdata.Key); err != nil {
+			fmt.Printf("Erro ao assinar checkpoint: %v\n", err)
+			break
+		}
+		current, checkpoint, changed = own, own, true
+	}
+
+	var message string
+	if changed {
+		if err := saveCheckpoint(current); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+		message = fmt.Sprintf("CHECKPOINT %s", base64.StdEncoding.EncodeToString(current.Serialize()))
+		fmt.Printf("Checkpoint do bloco %d com %d assinaturas\n", current.Height, len(current.Signatures))
+	}
+	checkpoint_lock.Unlock()
+
+	if changed {
+		broadcastLeaders(message)
+	}
+}
+
+func handleGetCheckpoint(conn net.Conn, parts []string) {
+	checkpoint_lock.Lock()
+	current := currentCheckpoint()
+	checkpoint_lock.Unlock()
+
+	if current == nil {
+		sendMessage("CHECKPOINT_DATA", conn)
+		return
+	}
+	sendMessage(fmt.Sprintf("CHECKPOINT_DATA %s", base64.StdEncoding.EncodeToString(current.Serialize())), conn)
+}
+
+// fetchCheckpoint asks a leader for its latest checkpoint
+func fetchCheckpoint(ctx context.Context, conn net.Conn) (*Checkpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, RPC_TIMEOUT)
+	defer cancel()
+
+	response, err := request(ctx, conn, "GET_CHECKPOINT")
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Fields(response)
+	if len(parts) == 0 || parts[0] != "CHECKPOINT_DATA" {
+		return nil, fmt.Errorf("unexpected response %q", firstWord(response))
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("leader has no checkpoint")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return deserializeCheckpoint(data)
+}
+
+type checkpointReply struct {
+	conn       net.Conn
+	checkpoint *Checkpoint
+}
+
+// collectCheckpoints asks every leader for its checkpoint and returns the
+// replies received until all of them answered or ctx is done
+func collectCheckpoints(ctx context.Context) []checkpointReply {
+	leaders := peer_manager.Conns(ROLE_LEADER)
+	replies := make(chan checkpointReply, len(leaders))
+
+	for _, conn := range leaders {
+		go func(conn net.Conn) {
+			c, err := fetchCheckpoint(ctx, conn)
+			if err != nil {
+				fmt.Printf("Checkpoint de %s não recebido: %v\n", conn.RemoteAddr(), err)
+			}
+			replies <- checkpointReply{conn: conn, checkpoint: c}
+		}(conn)
+	}
+
+	received := make([]checkpointReply, 0, len(leaders))
+	for range leaders {
+		if reply := <-replies; reply.checkpoint != nil {
+			received = append(received, reply)
+		}
+	}
+	return received
+}
+
+// beginSync marks a sync as running, only one runs at a time
+func beginSync() error {
+	sync_lock.Lock()
+	defer sync_lock.Unlock()
+
+	if sync_active {
+		return fmt.Errorf("a sync is already running")
+	}
+	sync_active = true
+	return nil
+}
+
+func endSync() {
+	sync_lock.Lock()
+	sync_active = false
+	sync_lock.Unlock()
+}
+
+// latestCheckpoint picks the highest checkpoint with at least quorum valid
+// signatures of trusted leaders, nil when none qualifies
+func latestCheckpoint(replies []checkpointReply, quorum int, trusted map[PublicKey]bool) *checkpointReply {
+	var latest *checkpointReply
+	for i := range replies {
+		c := replies[i].checkpoint
+		if signers := c.validSigners(trusted); signers < quorum {
+			fmt.Printf("Checkpoint do bloco %d tem %d assinaturas válidas de líderes confiáveis, são necessárias %d\n", c.Height, signers, quorum)
+			continue
+		}
+		if latest == nil || c.Height > latest.checkpoint.Height {
+			latest = &replies[i]
+		}
+	}
+	return latest
+}
+
+// FastSync bootstraps the local chain from the latest checkpoint the leaders
+// answer with before ctx is done that has at least quorum valid signatures of
+// trusted leaders. Only the blocks after it are downloaded; the older history
+// is verified afterwards in the background.
+func FastSync(ctx context.Context, quorum int) error {
+	if quorum < 1 {
+		return fmt.Errorf("quorum must be at least 1")
+	}
+	if err := beginSync(); err != nil {
+		return err
+	}
+	defer endSync()
+
+	leaders, err := trustedLeaders()
+	if err != nil {
+		return err
+	}
+	if len(leaders) < quorum {
+		return fmt.Errorf("%s lists %d trusted leaders, a quorum of %d cannot be reached", LEADERS_PATH, len(leaders), quorum)
+	}
+
+	if peer_manager.Count(ROLE_LEADER) == 0 {
+		return fmt.Errorf("no leader available")
+	}
+
+	fmt.Printf("Solicitando checkpoints aos líderes\n")
+	latest := latestCheckpoint(collectCheckpoints(ctx), quorum, leaders)
+	if latest == nil {
+		return fmt.Errorf("no checkpoint with %d valid signatures of trusted leaders", quorum)
+	}
+	trusted, leaderConn := latest.checkpoint, latest.conn
+
+	fmt.Printf("Checkpoint do bloco %d aceito, baixando blocos a partir dele\n", trusted.Height)
+	synced, err := syncFrom(ctx, leaderConn, trusted)
+	if err != nil {
+		return fmt.Errorf("sync from checkpoint failed: %w", err)
+	}
+	if err := installSyncedChain(synced, trusted); err != nil {
+		return err
+	}
+
+	fmt.Printf("Blockchain sincronizada a partir do checkpoint, verificando o histórico anterior\n")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), HISTORY_TIMEOUT)
+		defer cancel()
+
+		if err := requestHistory(ctx, leaderConn); err != nil {
+			fmt.Printf("Histórico anterior ao checkpoint é inválido, descartando a blockchain sincronizada: %v\n", err)
+			if err := dropSyncedChain(trusted); err != nil {
+				fmt.Printf("%v\n", err)
+			}
+			return
+		}
+		fmt.Printf("Histórico anterior ao checkpoint verificado\n")
+	}()
+	return nil
+}
+
+func removeSyncFiles() {
+	os.Remove(SYNC_PATH)
+	os.Remove(SYNC_PATH + INDEX_SUFFIX)
+}
+
+// syncFrom downloads the blocks from the checkpoint on into a new chain file
+// at SYNC_PATH. The file is removed when the sync fails.
+func syncFrom(ctx context.Context, conn net.Conn, trusted *Checkpoint) (*NetherReader, error) {
+	return downloadChain(ctx, conn, SYNC_PATH, trusted.Height, light_mode.Load(), func(b *Block) error {
+		if b.Hash != trusted.BlockHash || verifyBlock(b, b.Index, b.PrevHash) != "" {
+			return fmt.Errorf("block %d does not match the checkpoint", b.Index)
+		}
+		return nil
+	})
+}
+
+// downloadChain streams the blocks of the peer from height from on into a new
+// chain file at path, until the peer has no more blocks. first checks the first
+// block, the others must follow it. The file is removed when the download fails.
+func downloadChain(ctx context.Context, conn net.Conn, path string, from uint64, headers bool, first func(b *Block) error) (*NetherReader, error) {
+	var downloaded *NetherReader
+	var blockErr error
+
+	err := streamBlocks(ctx, conn, from, headers, func(b *Block) bool {
+		if downloaded != nil {
+			blockErr = appendReceived(downloaded, b)
+			return blockErr == nil
+		}
+
+		if blockErr = first(b); blockErr != nil {
+			return false
+		}
+		if downloaded, blockErr = createChainFile(path, receivedBlock(b)); blockErr != nil {
+			return false
+		}
+		// Segments are named after the chain file, rotate only once installed
+		downloaded.segmentSize = 0
+		return true
+	})
+	if err == nil {
+		err = blockErr
+	}
+	if err == nil && downloaded == nil {
+		err = fmt.Errorf("peer has no block %d", from)
+	}
+
+	if err != nil {
+		if downloaded != nil {
+			downloaded.Close()
+		}
+		os.Remove(path)
+		os.Remove(path + INDEX_SUFFIX)
+		return nil, err
+	}
+	return downloaded, nil
+}
+
+// streamBlocks asks the peer for its blocks from height from on, one bounded
+// batch per request, and calls yield for each of them in order until the peer
+// has no more blocks or yield returns false
+func streamBlocks(ctx context.Context, conn net.Conn, from uint64, headers bool, yield func(b *Block) bool) error {
+	for {
+		blocks, err := fetchBlocks(ctx, conn, from, headers)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+
+		for _, b := range blocks {
+			if b.Index != from {
+				return fmt.Errorf("peer sent block %d, expected %d", b.Index, from)
+			}
+			if !yield(b) {
+				return nil
+			}
+			from++
+		}
+	}
+}
+
+// RequestBlocks downloads from a leader the blocks after the last local block
+func RequestBlocks(ctx context.Context) error {
+	if err := beginSync(); err != nil {
+		return err
+	}
+	defer endSync()
+
+	leaderConn, leaderExists := peer_manager.Any(ROLE_LEADER)
+	if !leaderExists {
+		return fmt.Errorf("no leader available")
+	}
+
+	r, done, err := loadedChain()
+	if err != nil {
+		return err
+	}
+	from := r.Metadata().LastBlockIndex + 1
+	done()
+
+	var appendErr error
+	err = streamBlocks(ctx, leaderConn, from, light_mode.Load(), func(b *Block) bool {
+		appendErr = appendBlocks([]*Block{b})
+		return appendErr == nil
+	})
+	if err == nil {
+		err = appendErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if r, done, err := loadedChain(); err == nil {
+		fmt.Printf("Blockchain atualizada até o bloco %d\n", r.Metadata().LastBlockIndex)
+		done()
+	}
+	return nil
+}
+
+// fetchBlocks asks the peer for the batch of blocks from height from on
+func fetchBlocks(ctx context.Context, conn net.Conn, from uint64, headers bool) ([]*Block, error) {
+	ctx, cancel := context.WithTimeout(ctx, RPC_TIMEOUT)
+	defer cancel()
+
+	response, err := request(ctx, conn, blocksRequest(from, headers))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Fields(response)
+	if len(parts) == 0 || parts[0] != "BLOCKS_DATA" {
+		return nil, fmt.Errorf("unexpected response %q", firstWord(response))
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("peer could not read its blocks")
+	}
+	if parts[1] != strconv.FormatUint(from, 10) {
+		return nil, fmt.Errorf("peer sent blocks from %s, asked from %d", parts[1], from)
+	}
+
+	blocks, err := decodeBlocks(strings.Join(parts[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+// handleGetBlocks answers with the blocks from the requested height on, at
+// most BLOCKS_BATCH of them and BLOCKS_BATCH_BYTES once serialized, so the
+// response always fits in a frame
+func handleGetBlocks(conn net.Conn, parts []string) {
+	if len(parts) < 2 {
+		return
+	}
+
+	from, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		fmt.Printf("Pedido de blocos em formato inválido: %v\n", err)
+		sendMessage("BLOCKS_DATA", conn)
+		return
+	}
+
+	r, done, err := loadedChain()
+	if err != nil {
+		sendMessage("BLOCKS_DATA", conn)
+		return
+	}
+	defer done()
+
+	// Light nodes ask only for the headers
+	headers := len(parts) > 2 && parts[2] == "headers"
+
+	blocks := make([]*Block, 0, BLOCKS_BATCH)
+	size := 0
+	err = NewChain(r).Iterate(context.Background(), Filter{FromIndex: from}, func(b *Block) bool {
+		if headers {
+			b = b.Header()
+		}
+		size += len(b.Serialize())
+		if len(blocks) > 0 && size > BLOCKS_BATCH_BYTES {
+			return false
+		}
+		blocks = append(blocks, b)
+		return len(blocks) < BLOCKS_BATCH
+	})
+	if err != nil {
+		fmt.Printf("Erro ao ler blocos: %v\n", err)
+		sendMessage("BLOCKS_DATA", conn)
+		return
+	}
+
+	sendMessage(fmt.Sprintf("BLOCKS_DATA %d %s", from, encodeBlocks(blocks)), conn)
+}
+
+// appendBlocks adds blocks received from a leader to the local chain
+func appendBlocks(blocks []*Block) error {
+	r, done, err := loadedChain()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for _, b := range blocks {
+		if err := appendReceived(r, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendReceived stores b, as kept in light mode, once it follows the last block of s
+func appendReceived(s ChainStore, b *Block) error {
+	_, err := s.Append(func(last *Block) (*Block, error) {
+		if reason := verifyBlock(b, last.Index+1, last.Hash); reason != "" {
+			return nil, fmt.Errorf("block %d does not follow the local chain: %s", b.Index, reason)
+		}
+		return receivedBlock(b), nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot store block %d: %w", b.Index, err)
+	}
+	return nil
+}
+
+// installSyncedChain replaces the local chain with the synced one and trusts
+// the checkpoint it was synced from
+func installSyncedChain(synced *NetherReader, trusted *Checkpoint) error {
+	err := synced.Verify()
+	synced.Close()
+	if err != nil {
+		removeSyncFiles()
+		return err
+	}
+
+	err = replaceChain(func() (ChainStore, error) {
+		if err := removeSegments(BLOCKCHAIN_PATH); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(SYNC_PATH, BLOCKCHAIN_PATH); err != nil {
+			return nil, fmt.Errorf("cannot replace blockchain: %w", err)
+		}
+		os.Rename(SYNC_PATH+INDEX_SUFFIX, BLOCKCHAIN_PATH+INDEX_SUFFIX)
+		return NewReader()
+	})
+	if err != nil {
+		return err
+	}
+
+	checkpoint_lock.Lock()
+	checkpoint = trusted
+	err = saveCheckpoint(checkpoint)
+	checkpoint_lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sync_lock.Lock()
+	history_verified = false
+	sync_lock.Unlock()
+	return nil
+}
+
+// dropSyncedChain removes the chain and the checkpoint installed by FastSync
+// from trusted once the history before it fails verification. A chain that
+// was replaced since, along with its checkpoint, is kept.
+func dropSyncedChain(trusted *Checkpoint) error {
+	reader_lock.Lock()
+	defer reader_lock.Unlock()
+	checkpoint_lock.Lock()
+	defer checkpoint_lock.Unlock()
+
+	if current := currentCheckpoint(); current == nil || current.digest() != trusted.digest() {
+		return nil
+	}
+
+	if reader != nil {
+		reader.Close()
+		reader = nil
+	}
+	checkpoint = nil
+	if err := os.Remove(CHECKPOINT_PATH); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove checkpoint: %w", err)
+	}
+
+	if err := removeSegments(BLOCKCHAIN_PATH); err != nil {
+		return err
+	}
+	os.Remove(BLOCKCHAIN_PATH + INDEX_SUFFIX)
+	if err := os.Remove(BLOCKCHAIN_PATH); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove blockchain: %w", err)
+	}
+	return nil
+}
+
+// requestHistory downloads the headers of the full chain of a peer and
+// verifies them against the checkpoint the local chain was bootstrapped from.
+// The downloaded file is discarded.
+func requestHistory(ctx context.Context, conn net.Conn) error {
+	history, err := downloadChain(ctx, conn, HISTORY_PATH, 0, true, func(b *Block) error {
+		if reason := verifyBlock(b, 0, b.PrevHash); reason != "" {
+			return fmt.Errorf("invalid genesis: %s", reason)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	history.Close()
+	defer os.Remove(HISTORY_PATH)
+	defer os.Remove(HISTORY_PATH + INDEX_SUFFIX)
+
+	if err := verifyHistory(HISTORY_PATH); err != nil {
+		return err
+	}
+
+	sync_lock.Lock()
+	history_verified = true
+	sync_lock.Unlock()
+	return nil
+}
+
+func verifyHistory(path string) error {
+	checkpoint_lock.Lock()
+	trusted := currentCheckpoint()
+	checkpoint_lock.Unlock()
+	if trusted == nil {
+		return fmt.Errorf("no checkpoint to verify against")
+	}
+
+	r, err := openReader(path, false)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if metadata := r.Metadata(); metadata.BaseIndex != 0 {
+		return fmt.Errorf("history starts at block %d, not at the genesis", metadata.BaseIndex)
+	}
+	if err := r.Verify(); err != nil {
+		return err
+	}
+
+	own, err := checkpointAt(r, trusted.Height, nil)
+	if err != nil {
+		return err
+	}
+	if own.digest() != trusted.digest() {
+		return fmt.Errorf("state hash at block %d does not match the checkpoint", trusted.Height)
+	}
+	return nil
+}
+
+// CheckpointStatus describes the stored checkpoint and the history verification
+func CheckpointStatus() string {
+	checkpoint_lock.Lock()
+	current := currentCheckpoint()
+	checkpoint_lock.Unlock()
+
+	if current == nil {
+		return "No checkpoint"
+	}
+
+	sync_lock.Lock()
+	verified := history_verified
+	sync_lock.Unlock()
+
+	return fmt.Sprintf("%s\n\tHistory Verified: %v", current, verified)
+}
@@ -0,0 +1,172 @@
+package nether
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// After the handshake every byte between peers travels in records sealed with
+// AES-GCM. Each direction has its own key and counter; a record whose counter
+// is not the next expected one is a replay or a reorder and drops the connection.
+//
+//	record: length uint32 | counter uint64 | ciphertext
+const (
+	RECORD_HEADER_SIZE   int    = 4 + 8
+	MAX_RECORD_PLAINTEXT int    = 64 << 10
+	SESSION_TAG          string = "NETHER_SESSION"
+	DIALER_TO_LISTENER   string = "dialer->listener"
+	LISTENER_TO_DIALER   string = "listener->dialer"
+)
+
+type secureConn struct {
+	net.Conn
+
+	writeMu     sync.Mutex
+	sendCipher  cipher.AEAD
+	sendCounter uint64
+
+	readMu      sync.Mutex
+	recvCipher  cipher.AEAD
+	recvCounter uint64
+	pending     []byte
+}
+
+// identityECDH converts an identity key to its ECDH form, for the static part of the session secret
+func identityECDH(k Key) (*ecdh.PrivateKey, error) {
+	return ecdh.P256().NewPrivateKey(k.Sk[:])
+}
+
+func identityECDHPublic(pk PublicKey) (*ecdh.PublicKey, error) {
+	return ecdh.P256().NewPublicKey(append([]byte{4}, pk[:]...))
+}
+
+func sessionCipher(prk []byte, transcript Hash, direction string) cipher.AEAD {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(transcript[:])
+	mac.Write([]byte(direction))
+
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aesGCM, _ := cipher.NewGCM(block)
+	return aesGCM
+}
+
+// newSecureConn derives the session keys from the ephemeral and the static
+// ECDH secrets. The transcript binds them to the identities proven in the handshake.
+func newSecureConn(conn net.Conn, dialer authHello, listener authHello, ephemeral *ecdh.PrivateKey, isDialer bool) (*secureConn, error) {
+	peer := listener
+	if !isDialer {
+		peer = dialer
+	}
+
+	peerEphemeral, err := ecdh.P256().NewPublicKey(peer.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	ephemeralSecret, err := ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	static, err := identityECDH(userdata.Key)
+	if err != nil {
+		return nil, err
+	}
+	peerStatic, err := identityECDHPublic(peer.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	staticSecret, err := static.ECDH(peerStatic)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(SESSION_TAG))
+	mac.Write(ephemeralSecret)
+	mac.Write(staticSecret)
+	prk := mac.Sum(nil)
+
+	transcript := authTranscript(SESSION_TAG, dialer, listener)
+	toListener := sessionCipher(prk, transcript, DIALER_TO_LISTENER)
+	toDialer := sessionCipher(prk, transcript, LISTENER_TO_DIALER)
+
+	if isDialer {
+		return &secureConn{Conn: conn, sendCipher: toListener, recvCipher: toDialer}, nil
+	}
+	return &secureConn{Conn: conn, sendCipher: toDialer, recvCipher: toListener}, nil
+}
+
+func recordNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// Write seals p in one or more records
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+MAX_RECORD_PLAINTEXT)]
+
+		header := make([]byte, RECORD_HEADER_SIZE)
+		binary.LittleEndian.PutUint32(header, uint32(len(chunk)+c.sendCipher.Overhead()))
+		binary.LittleEndian.PutUint64(header[4:], c.sendCounter)
+		record := c.sendCipher.Seal(header, recordNonce(c.sendCipher, c.sendCounter), chunk, header)
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		c.sendCounter++
+		written += len(chunk)
+	}
+
+	return written, nil
+}
+
+// Read returns the plaintext of the next record, or what is left of the last one
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		header := make([]byte, RECORD_HEADER_SIZE)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+
+		size := int(binary.LittleEndian.Uint32(header))
+		counter := binary.LittleEndian.Uint64(header[4:])
+		if size < c.recvCipher.Overhead() || size > MAX_RECORD_PLAINTEXT+c.recvCipher.Overhead() {
+			return 0, fmt.Errorf("invalid record size %d", size)
+		}
+		if counter != c.recvCounter {
+			return 0, fmt.Errorf("record %d replayed or out of order, expected %d", counter, c.recvCounter)
+		}
+
+		ciphertext := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+			return 0, err
+		}
+
+		plaintext, err := c.recvCipher.Open(nil, recordNonce(c.recvCipher, counter), ciphertext, header)
+		if err != nil {
+			return 0, fmt.Errorf("record %d failed authentication", counter)
+		}
+		c.recvCounter++
+		c.pending = plaintext
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
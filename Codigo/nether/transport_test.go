@@ -0,0 +1,85 @@
+package nether
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// bufferConn is a connection whose reads and writes go to buffers
+type bufferConn struct {
+	net.Conn
+	in  *bytes.Reader
+	out *bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+// testSession returns a sender and a constructor of receivers reading its records
+func testSession() (*secureConn, *bytes.Buffer, func(data []byte) *secureConn) {
+	aead := sessionCipher([]byte("test session"), Hash{}, DIALER_TO_LISTENER)
+	out := &bytes.Buffer{}
+	sender := &secureConn{Conn: &bufferConn{out: out}, sendCipher: aead}
+
+	receiver := func(data []byte) *secureConn {
+		return &secureConn{Conn: &bufferConn{in: bytes.NewReader(data)}, recvCipher: aead}
+	}
+	return sender, out, receiver
+}
+
+func TestSecureConnRoundTrip(t *testing.T) {
+	sender, out, receiver := testSession()
+
+	// Spans several records
+	payload := bytes.Repeat([]byte("nether"), MAX_RECORD_PLAINTEXT/2)
+	if err := writeFrame(sender, FRAME_MESSAGE, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(sender, FRAME_RESPONSE, []byte("PONG")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := receiver(out.Bytes())
+	for _, want := range [][]byte{payload, []byte("PONG")} {
+		_, got, err := readFrame(conn, MAX_FRAME_SIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes, want %d", len(got), len(want))
+		}
+	}
+}
+
+func TestSecureConnRejectsReplayedRecord(t *testing.T) {
+	sender, out, receiver := testSession()
+	writeFrame(sender, FRAME_MESSAGE, []byte("PING"))
+	record := append([]byte(nil), out.Bytes()...)
+
+	conn := receiver(append(record, record...))
+	if _, _, err := readFrame(conn, MAX_FRAME_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readFrame(conn, MAX_FRAME_SIZE); err == nil {
+		t.Fatal("accepted a replayed record")
+	}
+}
+
+// FuzzSecureConnRead feeds arbitrary records to the decrypting side of a session
+func FuzzSecureConnRead(f *testing.F) {
+	sender, out, receiver := testSession()
+	writeFrame(sender, FRAME_MESSAGE, []byte("PING"))
+	f.Add(append([]byte(nil), out.Bytes()...))
+	writeFrame(sender, FRAME_REQUEST, bytes.Repeat([]byte{0xff}, MAX_RECORD_PLAINTEXT+1))
+	f.Add(append([]byte(nil), out.Bytes()...))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	const maxSize = 1 << 20
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, payload, err := readFrame(receiver(data), maxSize)
+		if err == nil && len(payload) > maxSize {
+			t.Fatalf("read a payload of %d bytes over the limit of %d", len(payload), maxSize)
+		}
+	})
+}
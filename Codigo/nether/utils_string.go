@@ -2,6 +2,7 @@ package nether
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"strings"
@@ -9,17 +10,22 @@ import (
 )
 
 func (b *Block) String() string {
+	storage := b.Storage.String()
+	if b.HeaderOnly {
+		storage = "header only"
+	}
+
 	return fmt.Sprintf(
-		"\tBlockSize: \t%v\n\tIndex: \t\t%v\n\tTimestamp: \t%v\n\tPrevHash: \t%s\n\tHash: \t\t%s\n\tSignature: \t%s\n\tPubKey: \t%s\n\tStorage: \t%v",
-		b.BlockSize, b.Index, time.Unix(int64(b.Timestamp), 0).Format("02-01-2006 15:04:05"),
-		base64.StdEncoding.EncodeToString(b.PrevHash[:]), base64.StdEncoding.EncodeToString(b.Hash[:]),
+		"\tBlockSize: \t%v\n\tVersion: \t%v\n\tIndex: \t\t%v\n\tTimestamp: \t%v\n\tPrevHash: \t%s\n\tMerkleRoot: \t%s\n\tHash: \t\t%s\n\tSignature: \t%s\n\tPubKey: \t%s\n\tStorage: \t%v",
+		b.BlockSize, b.Version, b.Index, time.Unix(int64(b.Timestamp), 0).Format("02-01-2006 15:04:05"),
+		base64.StdEncoding.EncodeToString(b.PrevHash[:]), base64.StdEncoding.EncodeToString(b.MerkleRoot[:]), base64.StdEncoding.EncodeToString(b.Hash[:]),
 		base64.StdEncoding.EncodeToString(b.Signature[:]), base64.StdEncoding.EncodeToString(b.PubKey[:]),
-		b.Storage.String())
+		storage)
 }
 
 func (m *UserData) String() string {
-	return fmt.Sprintf("Hash: %s\nPrivateKey: %s\nPublicKey: %s",
-		base64.StdEncoding.EncodeToString(m.Hash[:]),
+	return fmt.Sprintf("Name: %s\nHash: %s\nPrivateKey: %s\nPublicKey: %s",
+		m.Name, base64.StdEncoding.EncodeToString(m.Hash[:]),
 		base64.StdEncoding.EncodeToString(m.Key.Sk[:]),
 		base64.StdEncoding.EncodeToString(m.Key.Pk[:]))
 }
@@ -28,48 +34,159 @@ func (k *Key) String() string {
 	return fmt.Sprintf("Key (Sk: %s, Pk: %s)", k.Sk, k.Pk)
 }
 
-func (r NetherReader) String() string {
+func (r *NetherReader) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	fileInfo := "nil"
 	if r.file != nil {
 		fileInfo = r.file.Name()
 	}
 
-	blockInfo := "nil"
-	if r.current != nil {
-		blockInfo = fmt.Sprintf("Index: %d", r.current.Index)
-	}
+	return fmt.Sprintf(
+		"\tFile: %s\n\tSize: %d\n\tLocal Size: %d\n\tLast Block Index: %d\n\tLast Block Offset: %x\n\tFirst Block Hash: %s",
+		fileInfo, r.size, r.localSize, r.lastBlockIndex, r.lastBlockOffset, base64.StdEncoding.EncodeToString(r.firstBlockHash[:]),
+	)
+}
+
+func (m *MemoryStore) String() string {
+	metadata := m.Metadata()
 
 	return fmt.Sprintf(
-		"\tFile: %s\n\tCurrent Block: %s\n\tSize: %d\n\tLocal Size: %d\n\tLast Block Index: %d\n\tLast Block Offset: %x\n\tFirst Block Hash: %s",
-		fileInfo, blockInfo, r.size, r.localSize, r.lastBlockIndex, r.lastBlockOffset, base64.StdEncoding.EncodeToString(r.firstBlockHash[:]),
+		"\tFile: memory\n\tSize: %d\n\tLocal Size: %d\n\tLast Block Index: %d\n\tFirst Block Hash: %s",
+		metadata.Size, metadata.LocalSize, metadata.LastBlockIndex, base64.StdEncoding.EncodeToString(metadata.FirstBlockHash[:]),
 	)
 }
 
 func (e *Embedding) String() string {
-	intRepresentation := make([]int, len(e.data))
-	for i, v := range e.data {
-		intRepresentation[i] = int(v)
+	normalization := "none"
+	if e.normalization == NORMALIZATION_L2 {
+		normalization = "l2"
 	}
 
 	return fmt.Sprintf(
-		"(ID: %s, Data: %v)",
-		base64.StdEncoding.EncodeToString(e.id[:]),
-		intRepresentation[:5],
+		"(ID: %s, Normalization: %s, Data: %.4f)",
+		hex.EncodeToString(e.id[:]),
+		normalization,
+		e.data[:5],
 	)
 }
 
-func (s *Storage) String() string {
+func (d Direction) String() string {
+	switch d {
+	case DIRECTION_ENTRY:
+		return "entry"
+	case DIRECTION_EXIT:
+		return "exit"
+	default:
+		return "unknown"
+	}
+}
+
+func (r PeerRole) String() string {
+	switch r {
+	case ROLE_CLIENT:
+		return "client"
+	case ROLE_LEADER:
+		return "leader"
+	case ROLE_NODE:
+		return "node"
+	default:
+		return "unknown"
+	}
+}
+
+func (d PeerDirection) String() string {
+	switch d {
+	case PEER_INBOUND:
+		return "inbound"
+	case PEER_OUTBOUND:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+func (f *FaceEvent) String() string {
 	return fmt.Sprintf(
-		"Storage (\n\tEmbedding: %s\n\tImage: %s\n)",
-		s.Embedding.String(),
-		s.Image.data,
+		"(Camera: %s, Site: %s, Direction: %s, Confidence: %.2f, Track: %s, Captured: %s, Embedding: %s, Image: %s)",
+		f.CameraID, f.SiteID, f.Direction, f.Confidence, f.TrackID,
+		time.UnixMilli(int64(f.CapturedAt)).Format("02-01-2006 15:04:05.000"),
+		hex.EncodeToString(f.EmbeddingID[:]), hex.EncodeToString(f.ImageHash[:]),
 	)
 }
 
+func (img *Image) String() string {
+	if img.path != "" || img.hash == (Hash{}) {
+		return img.path
+	}
+	return hex.EncodeToString(img.hash[:])
+}
+
+func (s *Storage) String() string {
+	var sb strings.Builder
+	sb.WriteString("Storage (")
+	for i := range s.Embeddings {
+		sb.WriteString(fmt.Sprintf("\n\tEmbedding[%d]: %s", i, s.Embeddings[i].String()))
+	}
+	for i := range s.Images {
+		sb.WriteString(fmt.Sprintf("\n\tImage[%d]: %s", i, s.Images[i].String()))
+	}
+	for i := range s.Events {
+		sb.WriteString(fmt.Sprintf("\n\tEvent[%d]: %s", i, s.Events[i].String()))
+	}
+	sb.WriteString("\n)")
+	return sb.String()
+}
+
+func (c *Checkpoint) String() string {
+	trusted, _ := trustedLeaders()
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Checkpoint:\n\tHeight: %d\n\tBlock Hash: %x\n\tState Hash: %x\n\tSignatures: %d (%d valid from trusted leaders)",
+		c.Height, c.BlockHash, c.StateHash, len(c.Signatures), c.validSigners(trusted)))
+	for i := range c.Signatures {
+		sb.WriteString(fmt.Sprintf("\n\tSigner[%d]: %s", i, EncodePublicKey(c.Signatures[i].PubKey)))
+	}
+	return sb.String()
+}
+
 func EncodePublicKey(src [64]byte) string {
 	return base64.StdEncoding.EncodeToString(src[:])
 }
 
+// DecodePublicKey parses a base64 encoded public key, as printed by EncodePublicKey
+func DecodePublicKey(src string) (PublicKey, error) {
+	var pk PublicKey
+
+	decoded, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return pk, err
+	}
+	if len(decoded) != PUBLIC_KEY_SIZE {
+		return pk, fmt.Errorf("public key must have %d bytes, got %d", PUBLIC_KEY_SIZE, len(decoded))
+	}
+
+	copy(pk[:], decoded)
+	return pk, nil
+}
+
+// DecodeHash parses a hex encoded SHA-256 hash
+func DecodeHash(src string) (Hash, error) {
+	var hash Hash
+
+	decoded, err := hex.DecodeString(src)
+	if err != nil {
+		return hash, err
+	}
+	if len(decoded) != CIPHER_SIZE {
+		return hash, fmt.Errorf("hash must have %d bytes, got %d", CIPHER_SIZE, len(decoded))
+	}
+
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
 func randomString(minLength, maxLength int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
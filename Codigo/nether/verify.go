@@ -0,0 +1,184 @@
+package nether
+
+import (
+	"fmt"
+)
+
+// ChainError describes the first invalid block found while verifying the chain
+type ChainError struct {
+	Index  uint64
+	Offset int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("block %d (offset %x): %s", e.Index, e.Offset, e.Reason)
+}
+
+// verifyBlock checks a single block against its predecessor
+func verifyBlock(b *Block, prevIndex uint64, prevHash Hash) string {
+	if b.Index != prevIndex {
+		return fmt.Sprintf("unexpected index %d, expected %d", b.Index, prevIndex)
+	}
+
+	if b.PrevHash != prevHash {
+		return "PrevHash does not match the hash of the previous block"
+	}
+
+	// Header only blocks are checked against their storage when it is fetched
+	if !b.HeaderOnly {
+		if reason := verifyStorage(b); reason != "" {
+			return reason
+		}
+	}
+
+	check := *b
+	check.calculateHash()
+	if check.Hash != b.Hash {
+		return "stored Hash does not match the recomputed hash"
+	}
+
+	if !b.Verify(b.PubKey) {
+		return "invalid signature for PubKey"
+	}
+
+	return ""
+}
+
+// verifyStorage checks the storage of a block against its MerkleRoot
+func verifyStorage(b *Block) string {
+	if b.Storage.merkleRoot(b.Version) != b.MerkleRoot {
+		return "MerkleRoot does not match the storage entries"
+	}
+
+	if b.Version >= BLOCK_VERSION_EMBEDDING_ID {
+		for i := range b.Storage.Embeddings {
+			check := b.Storage.Embeddings[i]
+			check.generateId()
+			if check.id != b.Storage.Embeddings[i].id {
+				return fmt.Sprintf("embedding %d ID does not match its data", i)
+			}
+		}
+	}
+
+	if b.Version >= BLOCK_VERSION_FACE_EVENT {
+		if reason := verifyEvents(&b.Storage); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+// attachPayload returns header with the storage fetched from a peer, after
+// checking it against the header
+func attachPayload(header *Block, storage Storage) (*Block, error) {
+	full := *header
+	full.Storage = storage
+	full.HeaderOnly = false
+	full.computeSize()
+
+	if reason := verifyBlock(&full, full.Index, full.PrevHash); reason != "" {
+		return nil, fmt.Errorf("payload of block %d is invalid: %s", full.Index, reason)
+	}
+	return &full, nil
+}
+
+// verifyEvents checks that every event points to an embedding and an image of the same block
+func verifyEvents(s *Storage) string {
+	for i := range s.Events {
+		found := false
+		for j := range s.Embeddings {
+			if s.Embeddings[j].id == s.Events[i].EmbeddingID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("event %d references an embedding outside the block", i)
+		}
+
+		found = false
+		for j := range s.Images {
+			if s.Images[j].hash == s.Events[i].ImageHash {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Sprintf("event %d references an image outside the block", i)
+		}
+	}
+
+	return ""
+}
+
+// Verify walks every block of the chain and returns the first inconsistency found
+func (r *NetherReader) Verify() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var offset int64 = METADATA_SIZE
+	expectedIndex := r.baseIndex()
+	expectedPrev := r.firstBlockHash
+	var lastOffset int64
+	var last *Block
+	var withStorage uint64
+
+	for {
+		b, next, err := r.readBlockAt(offset)
+		if err != nil {
+			return &ChainError{Index: expectedIndex, Offset: offset, Reason: err.Error()}
+		}
+
+		if reason := verifyBlock(b, expectedIndex, expectedPrev); reason != "" {
+			return &ChainError{Index: expectedIndex, Offset: offset, Reason: reason}
+		}
+
+		if !b.HeaderOnly {
+			withStorage++
+		}
+		last = b
+		lastOffset = offset
+		offset = next
+
+		if b.Index >= r.lastBlockIndex {
+			break
+		}
+
+		expectedIndex = b.Index + 1
+		expectedPrev = b.Hash
+	}
+
+	if uint64(lastOffset) != r.lastBlockOffset {
+		return &ChainError{Index: last.Index, Offset: lastOffset, Reason: fmt.Sprintf("metadata points last block to offset %x", r.lastBlockOffset)}
+	}
+
+	if r.size != last.Index+1 {
+		return &ChainError{Index: last.Index, Offset: lastOffset, Reason: fmt.Sprintf("metadata size %d does not match %d blocks", r.size, last.Index+1)}
+	}
+
+	if r.localSize != withStorage {
+		return &ChainError{Index: last.Index, Offset: lastOffset, Reason: fmt.Sprintf("metadata local size %d does not match %d blocks with storage", r.localSize, withStorage)}
+	}
+
+	r.segMu.RLock()
+	end, err := r.logicalEnd()
+	r.segMu.RUnlock()
+	if err == nil && end != offset {
+		return &ChainError{Index: last.Index, Offset: offset, Reason: fmt.Sprintf("%d trailing bytes after last block", end-offset)}
+	}
+
+	return nil
+}
+
+// verifyChain opens the chain at path with a dedicated reader and verifies it
+func verifyChain(path string) error {
+	r, err := openReader(path, false)
+	if err != nil {
+		return fmt.Errorf("cannot open blockchain: %w", err)
+	}
+	defer r.Close()
+
+	return r.Verify()
+}
@@ -0,0 +1,161 @@
+package nether
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every peer connection has a single writer goroutine fed by a bounded queue,
+// so frames from concurrent handlers are written whole and in order. A sender
+// finding the queue full waits up to WRITE_QUEUE_TIMEOUT, then the peer is
+// considered stuck and disconnected.
+const (
+	WRITE_QUEUE_SIZE    int           = 256
+	WRITE_QUEUE_TIMEOUT time.Duration = 5 * time.Second
+	WRITE_TIMEOUT       time.Duration = 2 * time.Minute
+)
+
+type peerConn struct {
+	net.Conn
+
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	maxDepth atomic.Int64
+	sent     atomic.Uint64
+	stalls   atomic.Uint64
+}
+
+// QueueStats are the outbound queue metrics of one peer connection
+type QueueStats struct {
+	Peer     string
+	Depth    int
+	Capacity int
+	MaxDepth int
+	Sent     uint64
+	Stalls   uint64 // sends that found the queue full and had to wait
+}
+
+var (
+	peer_conns      = make(map[*peerConn]bool)
+	peer_conns_lock sync.Mutex
+)
+
+func newPeerConn(conn net.Conn) *peerConn {
+	c := &peerConn{
+		Conn:  conn,
+		queue: make(chan []byte, WRITE_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
+	addToMap(peer_conns, &peer_conns_lock, c, true)
+
+	go c.writeLoop()
+	return c
+}
+
+func (c *peerConn) writeLoop() {
+	for {
+		select {
+		case frame := <-c.queue:
+			c.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if _, err := c.Conn.Write(frame); err != nil {
+				if c.closed() {
+					return
+				}
+				fmt.Printf("[ERROR] Erro ao enviar para %s, desconectando: %v\n", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			c.sent.Add(1)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Write queues p to be sent by the writer goroutine. p must be a whole frame.
+func (c *peerConn) Write(p []byte) (int, error) {
+	frame := append([]byte(nil), p...)
+
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	case c.queue <- frame:
+	default:
+		c.stalls.Add(1)
+		timer := time.NewTimer(WRITE_QUEUE_TIMEOUT)
+		defer timer.Stop()
+
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		case c.queue <- frame:
+		case <-timer.C:
+			fmt.Printf("[ERROR] Peer %s não está consumindo mensagens, desconectando\n", c.RemoteAddr())
+			c.Close()
+			return 0, fmt.Errorf("write queue of %s is full", c.RemoteAddr())
+		}
+	}
+
+	c.recordDepth(int64(len(c.queue)))
+	return len(p), nil
+}
+
+// recordDepth raises maxDepth to depth; concurrent senders never lower it
+func (c *peerConn) recordDepth(depth int64) {
+	for {
+		current := c.maxDepth.Load()
+		if depth <= current || c.maxDepth.CompareAndSwap(current, depth) {
+			return
+		}
+	}
+}
+
+// Close stops the writer, dropping the frames still queued, and closes the connection
+func (c *peerConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.done)
+		deleteFromMap(peer_conns, &peer_conns_lock, c)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *peerConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *peerConn) stats() QueueStats {
+	return QueueStats{
+		Peer:     c.RemoteAddr().String(),
+		Depth:    len(c.queue),
+		Capacity: cap(c.queue),
+		MaxDepth: int(c.maxDepth.Load()),
+		Sent:     c.sent.Load(),
+		Stalls:   c.stalls.Load(),
+	}
+}
+
+// QueueMetrics returns the outbound queue metrics of every open peer connection
+func QueueMetrics() []QueueStats {
+	peer_conns_lock.Lock()
+	stats := make([]QueueStats, 0, len(peer_conns))
+	for c := range peer_conns {
+		stats = append(stats, c.stats())
+	}
+	peer_conns_lock.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Peer < stats[j].Peer })
+	return stats
+}
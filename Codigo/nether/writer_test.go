@@ -0,0 +1,27 @@
+package nether
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRecordDepthKeepsMaximum(t *testing.T) {
+	c := &peerConn{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every sender reports a falling depth after its peak
+			for depth := int64(w * 100); depth >= 0; depth-- {
+				c.recordDepth(depth)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := c.maxDepth.Load(); got != 700 {
+		t.Fatalf("maxDepth = %d, want 700", got)
+	}
+}